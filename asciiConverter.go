@@ -8,7 +8,7 @@ type CacaContext struct {
 }
 
 // cols is the number of chars in a row, ratio is the w/h of the canvas
-func NewCacaContext(cols int, bpp int, width int, height int) (*CacaContext, error) {
+func NewCacaContext(cols int, bpp int, width int, height int, profile *RenderProfile) (*CacaContext, error) {
 	ctx := new(CacaContext)
 	canvas := NewCacaCanvas(0, 0)
 	dither := NewCacaDither(bpp, width, height)
@@ -33,12 +33,7 @@ func NewCacaContext(cols int, bpp int, width int, height int) (*CacaContext, err
 		return nil, err
 	}
 
-	err = dither.SetAlgorithm("none")
-	if err != nil {
-		ctx.Free()
-		return nil, err
-	}
-	err = dither.SetColor("fullgray")
+	err = profile.Apply(dither)
 	if err != nil {
 		ctx.Free()
 		return nil, err
@@ -58,13 +53,25 @@ func (this *CacaContext) Free() {
 	}
 }
 
+// imageCellWidth is how many pixels wide images are scaled to per column
+// before they are dithered. Rows follow from the aspect of the movie, so a
+// char covers about imageCellWidth x 2*imageCellWidth pixels, enough for the
+// antialiasing of libcaca to average over, and far less to decode and dither
+// than the source size.
+const imageCellWidth = 4
+
+// imageScale returns how to scale images for cols columns.
+func imageScale(cols int, profile *RenderProfile) ImageScale {
+	return ImageScale{Width: cols * imageCellWidth, Filter: profile.Scaler}
+}
+
 type AsciiConverter struct {
 	cacaCtx *CacaContext
 	re      *regexp.Regexp
 }
 
-func NewAsciiConverter(movie *Movie, cols int) (*AsciiConverter, error) {
-	cacaCtx, err := NewCacaContext(cols, movie.Bpp, movie.Width, movie.Height)
+func NewAsciiConverter(movie *Movie, cols int, profile *RenderProfile) (*AsciiConverter, error) {
+	cacaCtx, err := NewCacaContext(cols, movie.Bpp, movie.Width, movie.Height, profile)
 	if err != nil {
 		return nil, err
 	}
@@ -97,6 +104,26 @@ func (this *AsciiConverter) ConvertToAnsi(image *ImageFrame) (string, error) {
 	return text, nil
 }
 
+func (this *AsciiConverter) ConvertToText(image *ImageFrame) (string, error) {
+	text, err := processCaca(CACA_EXPORT_FMT_TEXT, this.cacaCtx, image)
+	if err != nil {
+		return "", err
+	}
+	return text, nil
+}
+
+func (this *AsciiConverter) ConvertToCells(image *ImageFrame) (*CacaGrid, error) {
+	err := this.cacaCtx.dither.DitherImage(image.Data, this.cacaCtx.canvas)
+	if err != nil {
+		return nil, err
+	}
+	return this.cacaCtx.canvas.Cells(), nil
+}
+
+func (this *AsciiConverter) Convert(format CacaExportFormat, image *ImageFrame) (string, error) {
+	return processCaca(format, this.cacaCtx, image)
+}
+
 func processCaca(format CacaExportFormat, ctx *CacaContext, img *ImageFrame) (string, error) {
 	err := ctx.dither.DitherImage(img.Data, ctx.canvas)
 	if err != nil {
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/jiaz/gmf"
+)
+
+// Audio is decoded to 16 bit little endian PCM, interleaved, which browsers
+// play through the Web Audio API without another decoder. Samples keep the
+// rate of the source, channels beyond the first two are dropped. Decoded
+// frames are grouped into chunks of about audioChunkDuration, each stored
+// like a movie frame with the timestamp of its first sample.
+
+const (
+	audioChunkDuration = 250 * time.Millisecond
+	maxAudioChannels   = 2
+)
+
+const audioChunkRate = float64(time.Second) / float64(audioChunkDuration)
+
+var ErrNoAudio = errors.New("Movie has no audio")
+
+type AudioChunk struct {
+	Data      []byte // s16le, interleaved
+	Timestamp time.Duration
+}
+
+type AudioTrack struct {
+	SampleRate  int
+	Channels    int // of the decoded chunks
+	ChunkStream <-chan *AudioChunk
+}
+
+// bytesPerSample returns the sample size of a decoded format, and whether
+// each channel is in its own plane.
+func bytesPerSample(format int32) (int, bool, error) {
+	switch format {
+	case gmf.AV_SAMPLE_FMT_U8:
+		return 1, false, nil
+	case gmf.AV_SAMPLE_FMT_U8P:
+		return 1, true, nil
+	case gmf.AV_SAMPLE_FMT_S16:
+		return 2, false, nil
+	case gmf.AV_SAMPLE_FMT_S16P:
+		return 2, true, nil
+	case gmf.AV_SAMPLE_FMT_S32, gmf.AV_SAMPLE_FMT_FLT:
+		return 4, false, nil
+	case gmf.AV_SAMPLE_FMT_S32P, gmf.AV_SAMPLE_FMT_FLTP:
+		return 4, true, nil
+	case gmf.AV_SAMPLE_FMT_DBL:
+		return 8, false, nil
+	case gmf.AV_SAMPLE_FMT_DBLP:
+		return 8, true, nil
+	}
+	return 0, false, fmt.Errorf("Unsupported sample format: %d", format)
+}
+
+// sampleToS16 converts one sample of format.
+func sampleToS16(format int32, sample []byte) int16 {
+	var value float64
+	switch format {
+	case gmf.AV_SAMPLE_FMT_U8, gmf.AV_SAMPLE_FMT_U8P:
+		return int16(int(sample[0])-0x80) << 8
+	case gmf.AV_SAMPLE_FMT_S16, gmf.AV_SAMPLE_FMT_S16P:
+		return int16(binary.LittleEndian.Uint16(sample))
+	case gmf.AV_SAMPLE_FMT_S32, gmf.AV_SAMPLE_FMT_S32P:
+		return int16(int32(binary.LittleEndian.Uint32(sample)) >> 16)
+	case gmf.AV_SAMPLE_FMT_FLT, gmf.AV_SAMPLE_FMT_FLTP:
+		value = float64(math.Float32frombits(binary.LittleEndian.Uint32(sample)))
+	case gmf.AV_SAMPLE_FMT_DBL, gmf.AV_SAMPLE_FMT_DBLP:
+		value = math.Float64frombits(binary.LittleEndian.Uint64(sample))
+	}
+	// float samples are nominally within [-1, 1], but may overshoot
+	value = math.Max(-1, math.Min(1, value))
+	return int16(value * math.MaxInt16)
+}
+
+// interleaveS16 converts samples of every channel to s16le, keeping the
+// first outChannels. planes holds one plane per channel for planar formats,
+// or a single plane otherwise.
+func interleaveS16(format int32, planes [][]byte, samples int, channels int, outChannels int) ([]byte, error) {
+	size, planar, err := bytesPerSample(format)
+	if err != nil {
+		return nil, err
+	}
+	if outChannels > channels {
+		return nil, errors.New("Not enough channels")
+	}
+	planeSize, needed := samples*size, outChannels
+	if !planar {
+		planeSize, needed = samples*size*channels, 1
+	}
+	if len(planes) < needed {
+		return nil, errors.New("Missing audio planes")
+	}
+	for _, plane := range planes[:needed] {
+		if len(plane) < planeSize {
+			return nil, errors.New("Audio plane too short")
+		}
+	}
+
+	output := make([]byte, samples*outChannels*2)
+	for s := 0; s < samples; s++ {
+		for c := 0; c < outChannels; c++ {
+			var sample []byte
+			if planar {
+				sample = planes[c][s*size:]
+			} else {
+				sample = planes[0][(s*channels+c)*size:]
+			}
+			binary.LittleEndian.PutUint16(output[(s*outChannels+c)*2:], uint16(sampleToS16(format, sample)))
+		}
+	}
+	return output, nil
+}
+
+// decodeAudioFrame converts a decoded frame to s16le with outChannels.
+func decodeAudioFrame(frame *gmf.Frame, outChannels int) ([]byte, error) {
+	format := int32(frame.Format())
+	_, planar, err := bytesPerSample(format)
+	if err != nil {
+		return nil, err
+	}
+	planes := make([][]byte, 1)
+	if planar {
+		planes = make([][]byte, frame.Channels())
+	}
+	for i := range planes {
+		planes[i] = frame.DataUnsafe(i)
+	}
+	return interleaveS16(format, planes, frame.NbSamples(), frame.Channels(), outChannels)
+}
+
+func loadAudio(srcFileName string) (*AudioTrack, error) {
+	inputCtx, err := gmf.NewInputCtx(srcFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	srcStream, err := inputCtx.GetBestStream(gmf.AVMEDIA_TYPE_AUDIO)
+	if err != nil {
+		inputCtx.CloseInputAndRelease()
+		return nil, ErrNoAudio
+	}
+	srcCtx := srcStream.CodecCtx()
+	if srcCtx.SampleRate() <= 0 || srcCtx.Channels() <= 0 {
+		inputCtx.CloseInputAndRelease()
+		return nil, ErrNoAudio
+	}
+
+	output := make(chan *AudioChunk)
+	track := &AudioTrack{
+		SampleRate:  srcCtx.SampleRate(),
+		Channels:    srcCtx.Channels(),
+		ChunkStream: output,
+	}
+	if track.Channels > maxAudioChannels {
+		track.Channels = maxAudioChannels
+	}
+	timeBase := srcStream.TimeBase().AVR()
+
+	go func() {
+		defer inputCtx.CloseInputAndRelease()
+		defer close(output)
+
+		chunkBytes := int(int64(track.SampleRate)*int64(audioChunkDuration)/int64(time.Second)) * track.Channels * 2
+		var chunk *AudioChunk
+		// samples decoded so far place frames that lack a timestamp
+		var decoded int64
+
+		for packet := range inputCtx.GetNewPackets() {
+			if packet.StreamIndex() != srcStream.Index() {
+				gmf.Release(packet)
+				continue
+			}
+
+			for frame := range packet.Frames(srcCtx) {
+				timestamp := time.Duration(decoded) * time.Second / time.Duration(track.SampleRate)
+				if pts := frame.BestEffortTimestamp(); pts != noPts {
+					timestamp = ptsToDuration(pts, timeBase)
+				}
+				decoded += int64(frame.NbSamples())
+
+				data, err := decodeAudioFrame(frame, track.Channels)
+				if err != nil {
+					// lose one frame rather than the whole track
+					log.Println("Skipping audio frame:", srcFileName, err)
+					continue
+				}
+				if chunk == nil {
+					chunk = &AudioChunk{Timestamp: timestamp}
+				}
+				chunk.Data = append(chunk.Data, data...)
+				if len(chunk.Data) >= chunkBytes {
+					output <- chunk
+					chunk = nil
+				}
+			}
+			gmf.Release(packet)
+		}
+		if chunk != nil {
+			output <- chunk
+		}
+	}()
+
+	return track, nil
+}
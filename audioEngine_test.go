@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/jiaz/gmf"
+)
+
+func TestInterleaveS16(t *testing.T) {
+	float32s := func(values ...float32) []byte {
+		data := make([]byte, 4*len(values))
+		for i, value := range values {
+			binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(value))
+		}
+		return data
+	}
+	s16 := func(values ...int16) []byte {
+		data := make([]byte, 2*len(values))
+		for i, value := range values {
+			binary.LittleEndian.PutUint16(data[2*i:], uint16(value))
+		}
+		return data
+	}
+
+	for _, test := range []struct {
+		name        string
+		format      int32
+		planes      [][]byte
+		channels    int
+		outChannels int
+		expected    []byte
+	}{
+		{"s16 stereo", gmf.AV_SAMPLE_FMT_S16, [][]byte{s16(1, -1, 2, -2)}, 2, 2, s16(1, -1, 2, -2)},
+		{"s16p stereo", gmf.AV_SAMPLE_FMT_S16P, [][]byte{s16(1, 2), s16(-1, -2)}, 2, 2, s16(1, -1, 2, -2)},
+		{"fltp clipped", gmf.AV_SAMPLE_FMT_FLTP, [][]byte{float32s(0.5, 2)}, 1, 1, s16(16383, math.MaxInt16)},
+		{"flt surround", gmf.AV_SAMPLE_FMT_FLT, [][]byte{float32s(1, -1, 0, 0, 0, 0)}, 6, 2, s16(math.MaxInt16, -math.MaxInt16)},
+		{"u8 mono", gmf.AV_SAMPLE_FMT_U8, [][]byte{{0x80, 0xff, 0x00}}, 1, 1, s16(0, 0x7f00, -0x8000)},
+	} {
+		samples := len(test.expected) / 2 / test.outChannels
+		output, err := interleaveS16(test.format, test.planes, samples, test.channels, test.outChannels)
+		if err != nil {
+			t.Error(test.name, err)
+		} else if !bytes.Equal(output, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, output)
+		}
+	}
+
+	if _, err := interleaveS16(gmf.AV_SAMPLE_FMT_S16P, [][]byte{s16(1, 2)}, 2, 2, 2); err == nil {
+		t.Error("Expected error for a missing plane")
+	}
+	if _, err := interleaveS16(gmf.AV_SAMPLE_FMT_S16, [][]byte{s16(1, 2)}, 2, 2, 2); err == nil {
+		t.Error("Expected error for a short plane")
+	}
+	if _, err := interleaveS16(-1, [][]byte{s16(1)}, 1, 1, 1); err == nil {
+		t.Error("Expected error for an unknown format")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// In binary mode frames are sent as binary websocket messages instead of
+// base64 in JSON. Every message starts with a fixed header, followed by the
+// frame payload as it is stored:
+//
+//   version:u8 kind:u8 codec:u8 flags:u8 requestId:u32 index:u32 timestamp:u32
+//
+// kind tells which command the frame answers, codec is the FrameCodec id the
+// payload is compressed with, flag bit 0 marks a delta frame, and timestamp
+// is in milliseconds.
+// requestId is 0 if the request had no id. Requests for binary frames must
+// have ids that are integers from 0 to 2^32-1, others are rejected. All
+// integers are little endian. Every other response stays JSON.
+
+const (
+	binaryFrameVersion    = 1
+	binaryFrameHeaderSize = 16
+)
+
+const (
+	binaryFrameData  byte = 1 // GETDATA
+	binaryFrameLive  byte = 2 // FRAME
+	binaryFrameAudio byte = 3 // GETAUDIO
+)
+
+// FrameMode selects how frames are sent on a connection.
+type FrameMode int
+
+const (
+	FRAME_MODE_JSON FrameMode = iota
+	FRAME_MODE_BINARY
+)
+
+var frameModeNames = []string{"json", "binary"}
+
+func (this FrameMode) String() string {
+	return frameModeNames[this]
+}
+
+func ParseFrameMode(name string) (FrameMode, error) {
+	for i, modeName := range frameModeNames {
+		if modeName == name {
+			return FrameMode(i), nil
+		}
+	}
+	return FRAME_MODE_JSON, errors.New("Unsupported frame mode: " + name)
+}
+
+var ErrBinaryRequestId = errors.New("Binary frames need request ids that are integers from 0 to 4294967295")
+
+// binaryRequestId returns the id binary frames answering requestId carry.
+func binaryRequestId(requestId interface{}) (uint32, error) {
+	if requestId == nil {
+		return 0, nil
+	}
+	if id, ok := requestId.(float64); ok && id >= 0 && id <= 0xffffffff && id == float64(uint32(id)) {
+		return uint32(id), nil
+	}
+	return 0, ErrBinaryRequestId
+}
+
+// checkRequestId rejects request ids that frames sent in mode cannot carry.
+func checkRequestId(mode FrameMode, requestId interface{}) error {
+	if mode != FRAME_MODE_BINARY {
+		return nil
+	}
+	_, err := binaryRequestId(requestId)
+	return err
+}
+
+func encodeBinaryFrame(kind byte, requestId uint32, index int, frame StoredFrame) []byte {
+	message := make([]byte, binaryFrameHeaderSize+len(frame.Payload))
+	message[0] = binaryFrameVersion
+	message[1] = kind
+	message[2] = frame.Codec
+	if !frame.Keyframe {
+		message[3] |= frameFlagDelta
+	}
+	binary.LittleEndian.PutUint32(message[4:], requestId)
+	binary.LittleEndian.PutUint32(message[8:], uint32(index))
+	binary.LittleEndian.PutUint32(message[12:], uint32(frame.Timestamp/time.Millisecond))
+	copy(message[binaryFrameHeaderSize:], frame.Payload)
+	return message
+}
+
+// sendFrame sends one frame in the given mode. cmdType is the type of the
+// JSON response, and picks the kind of the binary one.
+func sendFrame(conn *websocket.Conn, mode FrameMode, cmdType string, requestId interface{}, entry *MovieEntry, key RenditionKey, index int, frame StoredFrame) error {
+	if mode == FRAME_MODE_BINARY {
+		kind := binaryFrameData
+		switch cmdType {
+		case "FRAME":
+			kind = binaryFrameLive
+		case "GETAUDIO":
+			kind = binaryFrameAudio
+		}
+		id, err := binaryRequestId(requestId)
+		if err != nil {
+			return err
+		}
+		return websocket.Message.Send(conn, encodeBinaryFrame(kind, id, index, frame))
+	}
+	if cmdType == "GETAUDIO" {
+		return websocket.JSON.Send(conn, WSResponse{200, cmdType, chunkData(entry, index, frame), requestId})
+	}
+	return websocket.JSON.Send(conn, WSResponse{200, cmdType, frameData(entry, key, index, frame), requestId})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestEncodeBinaryFrame(t *testing.T) {
+	payload := []byte("gzipped frame")
+	message := encodeBinaryFrame(binaryFrameLive, 42, 7, StoredFrame{payload, 1500 * time.Millisecond, 3, false})
+
+	if len(message) != binaryFrameHeaderSize+len(payload) {
+		t.Fatal("Unexpected message length:", len(message))
+	}
+	if message[0] != binaryFrameVersion || message[1] != binaryFrameLive || message[2] != 3 || message[3] != frameFlagDelta {
+		t.Error("Unexpected header:", message[:4])
+	}
+	for _, field := range []struct {
+		name     string
+		offset   int
+		expected uint32
+	}{
+		{"request id", 4, 42},
+		{"index", 8, 7},
+		{"timestamp", 12, 1500},
+	} {
+		if value := binary.LittleEndian.Uint32(message[field.offset:]); value != field.expected {
+			t.Errorf("Unexpected %s: %d", field.name, value)
+		}
+	}
+	if !bytes.Equal(message[binaryFrameHeaderSize:], payload) {
+		t.Error("Unexpected payload:", message[binaryFrameHeaderSize:])
+	}
+}
+
+func TestBinaryRequestId(t *testing.T) {
+	for _, test := range []struct {
+		requestId interface{}
+		expected  uint32
+	}{
+		{nil, 0},
+		{float64(0), 0},
+		{float64(42), 42},
+		{float64(0xffffffff), 0xffffffff},
+	} {
+		if id, err := binaryRequestId(test.requestId); err != nil || id != test.expected {
+			t.Error("Unexpected id for request id:", test.requestId, id, err)
+		}
+	}
+	for _, id := range []interface{}{"abc", float64(-1), 1.5, float64(1 << 32), true} {
+		if _, err := binaryRequestId(id); err != ErrBinaryRequestId {
+			t.Error("Expected error for request id:", id, err)
+		}
+		if err := checkRequestId(FRAME_MODE_JSON, id); err != nil {
+			t.Error("JSON frames carry any request id:", id, err)
+		}
+		if err := checkRequestId(FRAME_MODE_BINARY, id); err != ErrBinaryRequestId {
+			t.Error("Expected error in binary mode for request id:", id, err)
+		}
+	}
+}
@@ -3,21 +3,45 @@ package main
 /*
 
 #cgo pkg-config: caca
+#include <stdint.h>
 #include <stdlib.h>
 #include <stdio.h>
 #include <errno.h>
 #include <caca.h>
 
+// worst case of one cell: a span with every style, the longest entity and
+// the closing tag
+#define HTML_DIV_CELL_MAX (47 + 83 + 10 + 7)
+#define HTML_DIV_LINE_EXTRA 7
+
 void *caca_export_html_div(caca_canvas_t const *cv, size_t *bytes)
 {
     char *data, *cur;
     int x, y, len, w, h;
+    size_t line;
 
 	w = caca_get_canvas_width(cv);
 	h = caca_get_canvas_height(cv);
 
-	*bytes = 1000 + h * (7 + w * (47 + 83 + 10 + 7));
+    // the canvas size is not bounded, check before multiplying
+    if(w < 0 || h < 0 || (size_t)w > (SIZE_MAX - HTML_DIV_LINE_EXTRA) / HTML_DIV_CELL_MAX)
+    {
+        errno = EOVERFLOW;
+        return NULL;
+    }
+    line = HTML_DIV_LINE_EXTRA + (size_t)w * HTML_DIV_CELL_MAX;
+    if((size_t)h > (SIZE_MAX - 1000) / line)
+    {
+        errno = EOVERFLOW;
+        return NULL;
+    }
+    *bytes = 1000 + (size_t)h * line;
     cur = data = malloc(*bytes);
+    if(data == NULL)
+    {
+        errno = ENOMEM;
+        return NULL;
+    }
 
     cur += sprintf(cur, "<div>");
 
@@ -95,6 +119,55 @@ void *caca_export_html_div(caca_canvas_t const *cv, size_t *bytes)
     return data;
 }
 
+void *caca_export_text(caca_canvas_t const *cv, size_t *bytes)
+{
+    char *data, *cur;
+    int x, y, w, h;
+    size_t line;
+
+    w = caca_get_canvas_width(cv);
+    h = caca_get_canvas_height(cv);
+
+    // at most 4 bytes of UTF-8 per char, plus a newline per line
+    if(w < 0 || h < 0 || (size_t)w > (SIZE_MAX - 1) / 4)
+    {
+        errno = EOVERFLOW;
+        return NULL;
+    }
+    line = 1 + (size_t)w * 4;
+    if((size_t)h > (SIZE_MAX - 1) / line)
+    {
+        errno = EOVERFLOW;
+        return NULL;
+    }
+    *bytes = 1 + (size_t)h * line;
+    cur = data = malloc(*bytes);
+    if(data == NULL)
+    {
+        errno = ENOMEM;
+        return NULL;
+    }
+
+    for(y = 0; y < h; y++)
+    {
+        const uint32_t *linechar = caca_get_canvas_chars(cv) + y * w;
+
+        for(x = 0; x < w; x++)
+        {
+            uint32_t ch = linechar[x];
+            if(ch == CACA_MAGIC_FULLWIDTH)
+                continue;
+            cur += caca_utf32_to_utf8(cur, ch);
+        }
+        *cur++ = '\n';
+    }
+
+    *bytes = (uintptr_t)(cur - data);
+    data = realloc(data, *bytes);
+
+    return data;
+}
+
 
 */
 import "C"
@@ -113,22 +186,69 @@ var (
 
 type CacaExportFormat uint8
 
+// Formats the server exports itself come first, the other formats libcaca
+// supports are added after them at startup.
 const (
 	CACA_EXPORT_FMT_ANSI CacaExportFormat = iota
 	CACA_EXPORT_FMT_HTML
 	CACA_EXPORT_FMT_HTMLDIV
+	CACA_EXPORT_FMT_TEXT
+	CACA_EXPORT_FMT_CELLS
+	CACA_EXPORT_FMT_HTMLCLASS
 )
 
-var exportFmt []*C.char = []*C.char{
-	C.CString("ansi"),
-	C.CString("html"),
-	C.CString("htmldiv"),
+var exportFormats = []CacaOption{
+	{"ansi", "ANSI"},
+	{"html", "HTML"},
+	{"htmldiv", "HTML div with inline styles"},
+	{"text", "Plain UTF-8 text"},
+	{"cells", "JSON cell grid"},
+	{"htmlclass", "HTML pre with CSS classes"},
+}
+
+var exportFmt []*C.char
+
+func init() {
+	for _, format := range exportFormats {
+		exportFmt = append(exportFmt, C.CString(format.Name))
+	}
+	for _, format := range goOptionList(C.caca_get_export_list()) {
+		if _, err := ParseCacaExportFormat(format.Name); err == nil {
+			continue
+		}
+		if len(exportFormats) > 0xff {
+			break
+		}
+		exportFormats = append(exportFormats, format)
+		exportFmt = append(exportFmt, C.CString(format.Name))
+	}
+}
+
+// CacaExportFormats lists every format with its description.
+func CacaExportFormats() []CacaOption {
+	return exportFormats
 }
 
 func (fmt CacaExportFormat) toCacaFmt() *C.char {
 	return exportFmt[fmt]
 }
 
+func (fmt CacaExportFormat) String() string {
+	if int(fmt) >= len(exportFormats) {
+		return "unknown"
+	}
+	return exportFormats[fmt].Name
+}
+
+func ParseCacaExportFormat(name string) (CacaExportFormat, error) {
+	for i, format := range exportFormats {
+		if format.Name == name {
+			return CacaExportFormat(i), nil
+		}
+	}
+	return 0, errors.New("Unsupported format: " + name)
+}
+
 type CacaCanvas struct {
 	canvas *C.struct_caca_canvas
 }
@@ -161,17 +281,25 @@ func (this *CacaCanvas) SetColorAnsi(fg uint8, bg uint8) error {
 }
 
 func (this *CacaCanvas) ExportTo(format CacaExportFormat) (string, error) {
+	if int(format) >= len(exportFmt) {
+		return "", fmt.Errorf("Unsupported format: %d", int(format))
+	}
 	var length int
 	var err error
 	var ret unsafe.Pointer
 	cacaFmt := format.toCacaFmt()
 	switch format {
-	case CACA_EXPORT_FMT_ANSI, CACA_EXPORT_FMT_HTML:
-		ret, err = C.caca_export_canvas_to_memory(this.canvas, cacaFmt, (*C.size_t)(unsafe.Pointer(&length)))
 	case CACA_EXPORT_FMT_HTMLDIV:
 		ret, err = C.caca_export_html_div(this.canvas, (*C.size_t)(unsafe.Pointer(&length)))
+	case CACA_EXPORT_FMT_TEXT:
+		ret, err = C.caca_export_text(this.canvas, (*C.size_t)(unsafe.Pointer(&length)))
+	case CACA_EXPORT_FMT_CELLS:
+		output, err := this.Cells().MarshalJSON()
+		return string(output), err
+	case CACA_EXPORT_FMT_HTMLCLASS:
+		return string(this.Cells().HtmlClass()), nil
 	default:
-		panic(fmt.Sprintf("Unsupported format: %d", int(format)))
+		ret, err = C.caca_export_canvas_to_memory(this.canvas, cacaFmt, (*C.size_t)(unsafe.Pointer(&length)))
 	}
 	if ret == nil || err != nil {
 		if err == nil {
@@ -189,6 +317,30 @@ func (this *CacaCanvas) Clear() error {
 	return checkRet(ret, err)
 }
 
+// Cells reads the chars and attributes of the canvas into a grid.
+func (this *CacaCanvas) Cells() *CacaGrid {
+	grid := NewCacaGrid(this.Width(), this.Height())
+	count := len(grid.Cells)
+	if count == 0 {
+		return grid
+	}
+	chars := (*[1 << 28]C.uint32_t)(unsafe.Pointer(C.caca_get_canvas_chars(this.canvas)))[:count:count]
+	attrs := (*[1 << 28]C.uint32_t)(unsafe.Pointer(C.caca_get_canvas_attrs(this.canvas)))[:count:count]
+	for i, attr := range attrs {
+		char := rune(chars[i])
+		if chars[i] == C.CACA_MAGIC_FULLWIDTH {
+			char = 0
+		}
+		grid.Cells[i] = CacaCell{
+			Char: char,
+			Fg:   uint8(C.caca_attr_to_ansi_fg(attr)),
+			Bg:   uint8(C.caca_attr_to_ansi_bg(attr)),
+			Attr: uint8(attr) & (CACA_STYLE_BOLD | CACA_STYLE_ITALICS | CACA_STYLE_UNDERLINE | CACA_STYLE_BLINK),
+		}
+	}
+	return grid
+}
+
 type CacaDither struct {
 	dither *C.struct_caca_dither
 }
@@ -204,6 +356,26 @@ func (this *CacaDither) Free() error {
 	return checkRet(ret, err)
 }
 
+// CacaOption is one entry of the value lists libcaca reports for dither
+// settings.
+type CacaOption struct {
+	Name        string
+	Description string
+}
+
+// goOptionList converts a NULL terminated list of name/description pairs.
+func goOptionList(list **C.char) []CacaOption {
+	var options []CacaOption
+	if list == nil {
+		return options
+	}
+	entries := (*[1 << 10]*C.char)(unsafe.Pointer(list))
+	for i := 0; entries[i] != nil && entries[i+1] != nil; i += 2 {
+		options = append(options, CacaOption{C.GoString(entries[i]), C.GoString(entries[i+1])})
+	}
+	return options
+}
+
 func (this *CacaDither) SetAlgorithm(algo string) error {
 	algoCString := C.CString(algo)
 	defer C.free(unsafe.Pointer(algoCString))
@@ -211,6 +383,14 @@ func (this *CacaDither) SetAlgorithm(algo string) error {
 	return checkRet(ret, err)
 }
 
+func (this *CacaDither) Algorithm() string {
+	return C.GoString(C.caca_get_dither_algorithm(this.dither))
+}
+
+func (this *CacaDither) AlgorithmList() []CacaOption {
+	return goOptionList(C.caca_get_dither_algorithm_list(this.dither))
+}
+
 func (this *CacaDither) SetColor(color string) error {
 	colorCString := C.CString(color)
 	defer C.free(unsafe.Pointer(colorCString))
@@ -218,6 +398,71 @@ func (this *CacaDither) SetColor(color string) error {
 	return checkRet(ret, err)
 }
 
+func (this *CacaDither) Color() string {
+	return C.GoString(C.caca_get_dither_color(this.dither))
+}
+
+func (this *CacaDither) ColorList() []CacaOption {
+	return goOptionList(C.caca_get_dither_color_list(this.dither))
+}
+
+func (this *CacaDither) SetCharset(charset string) error {
+	charsetCString := C.CString(charset)
+	defer C.free(unsafe.Pointer(charsetCString))
+	ret, err := C.caca_set_dither_charset(this.dither, charsetCString)
+	return checkRet(ret, err)
+}
+
+func (this *CacaDither) Charset() string {
+	return C.GoString(C.caca_get_dither_charset(this.dither))
+}
+
+func (this *CacaDither) CharsetList() []CacaOption {
+	return goOptionList(C.caca_get_dither_charset_list(this.dither))
+}
+
+func (this *CacaDither) SetAntialias(antialias string) error {
+	antialiasCString := C.CString(antialias)
+	defer C.free(unsafe.Pointer(antialiasCString))
+	ret, err := C.caca_set_dither_antialias(this.dither, antialiasCString)
+	return checkRet(ret, err)
+}
+
+func (this *CacaDither) Antialias() string {
+	return C.GoString(C.caca_get_dither_antialias(this.dither))
+}
+
+func (this *CacaDither) AntialiasList() []CacaOption {
+	return goOptionList(C.caca_get_dither_antialias_list(this.dither))
+}
+
+func (this *CacaDither) SetBrightness(brightness float64) error {
+	ret, err := C.caca_set_dither_brightness(this.dither, C.float(brightness))
+	return checkRet(ret, err)
+}
+
+func (this *CacaDither) Brightness() float64 {
+	return float64(C.caca_get_dither_brightness(this.dither))
+}
+
+func (this *CacaDither) SetGamma(gamma float64) error {
+	ret, err := C.caca_set_dither_gamma(this.dither, C.float(gamma))
+	return checkRet(ret, err)
+}
+
+func (this *CacaDither) Gamma() float64 {
+	return float64(C.caca_get_dither_gamma(this.dither))
+}
+
+func (this *CacaDither) SetContrast(contrast float64) error {
+	ret, err := C.caca_set_dither_contrast(this.dither, C.float(contrast))
+	return checkRet(ret, err)
+}
+
+func (this *CacaDither) Contrast() float64 {
+	return float64(C.caca_get_dither_contrast(this.dither))
+}
+
 func (this *CacaDither) DitherImage(data []byte, canvas *CacaCanvas) error {
 	ret, err := C.caca_dither_bitmap(canvas.canvas,
 		0, 0, C.int(canvas.Width()), C.int(canvas.Height()),
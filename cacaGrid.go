@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// A CacaGrid is the content of a canvas as typed cells, for formats the
+// server produces itself instead of asking libcaca for them.
+
+// Style bits of CacaCell.Attr, as libcaca defines them.
+const (
+	CACA_STYLE_BOLD      uint8 = 0x01
+	CACA_STYLE_ITALICS   uint8 = 0x02
+	CACA_STYLE_UNDERLINE uint8 = 0x04
+	CACA_STYLE_BLINK     uint8 = 0x08
+)
+
+type CacaCell struct {
+	Char rune  // 0 for the right half of a fullwidth char
+	Fg   uint8 // ANSI color, CACA_DEFAULT or CACA_TRANSPARENT
+	Bg   uint8
+	Attr uint8 // CACA_STYLE_* bits
+}
+
+type CacaGrid struct {
+	Width  int
+	Height int
+	Cells  []CacaCell // row by row
+}
+
+func NewCacaGrid(width int, height int) *CacaGrid {
+	return &CacaGrid{width, height, make([]CacaCell, width*height)}
+}
+
+func (this *CacaGrid) Cell(x int, y int) CacaCell {
+	return this.Cells[y*this.Width+x]
+}
+
+func (this *CacaGrid) Row(y int) []CacaCell {
+	return this.Cells[y*this.Width : (y+1)*this.Width]
+}
+
+// MarshalJSON encodes the grid with every cell as a [char, fg, bg, attr]
+// array, and one row per line so that row deltas between frames stay small.
+func (this *CacaGrid) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"Width":` + strconv.Itoa(this.Width) + `,"Height":` + strconv.Itoa(this.Height) + `,"Rows":[`)
+	for y := 0; y < this.Height; y++ {
+		if y > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString("\n[")
+		for x, cell := range this.Row(y) {
+			if x > 0 {
+				buf.WriteByte(',')
+			}
+			char := ""
+			if cell.Char != 0 {
+				char = string(cell.Char)
+			}
+			quoted, err := json.Marshal(char)
+			if err != nil {
+				return nil, err
+			}
+			buf.WriteByte('[')
+			buf.Write(quoted)
+			for _, value := range []uint8{cell.Fg, cell.Bg, cell.Attr} {
+				buf.WriteByte(',')
+				buf.WriteString(strconv.Itoa(int(value)))
+			}
+			buf.WriteByte(']')
+		}
+		buf.WriteByte(']')
+	}
+	buf.WriteString("\n]}")
+	return buf.Bytes(), nil
+}
+
+// The binary encoding is width:u16 height:u16, then per cell char:u32 fg:u8
+// bg:u8 attr:u8, little endian.
+const cacaCellSize = 7
+
+var ErrMalformedGrid = errors.New("Malformed cell grid")
+
+func (this *CacaGrid) MarshalBinary() ([]byte, error) {
+	if this.Width > 0xffff || this.Height > 0xffff {
+		return nil, errors.New("Grid too large")
+	}
+	data := make([]byte, 4+len(this.Cells)*cacaCellSize)
+	binary.LittleEndian.PutUint16(data[0:], uint16(this.Width))
+	binary.LittleEndian.PutUint16(data[2:], uint16(this.Height))
+	for i, cell := range this.Cells {
+		offset := 4 + i*cacaCellSize
+		binary.LittleEndian.PutUint32(data[offset:], uint32(cell.Char))
+		data[offset+4] = cell.Fg
+		data[offset+5] = cell.Bg
+		data[offset+6] = cell.Attr
+	}
+	return data, nil
+}
+
+func (this *CacaGrid) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return ErrMalformedGrid
+	}
+	width := int(binary.LittleEndian.Uint16(data[0:]))
+	height := int(binary.LittleEndian.Uint16(data[2:]))
+	if len(data) != 4+width*height*cacaCellSize {
+		return ErrMalformedGrid
+	}
+	*this = *NewCacaGrid(width, height)
+	for i := range this.Cells {
+		offset := 4 + i*cacaCellSize
+		this.Cells[i] = CacaCell{
+			Char: rune(binary.LittleEndian.Uint32(data[offset:])),
+			Fg:   data[offset+4],
+			Bg:   data[offset+5],
+			Attr: data[offset+6],
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testGrid() *CacaGrid {
+	grid := NewCacaGrid(3, 2)
+	grid.Cells[0] = CacaCell{'a', 7, 0, 0}
+	grid.Cells[1] = CacaCell{'<', 15, 4, CACA_STYLE_BOLD}
+	grid.Cells[2] = CacaCell{'"', CACA_DEFAULT, CACA_TRANSPARENT, 0}
+	grid.Cells[3] = CacaCell{'字', 1, 2, CACA_STYLE_UNDERLINE}
+	grid.Cells[4] = CacaCell{0, 1, 2, CACA_STYLE_UNDERLINE}
+	grid.Cells[5] = CacaCell{' ', 0, 0, 0}
+	return grid
+}
+
+func TestCacaGridJSON(t *testing.T) {
+	grid := testGrid()
+	data, err := grid.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != grid.Height+1 {
+		t.Error("Expected one row per line:", string(data))
+	}
+
+	var decoded struct {
+		Width  int
+		Height int
+		Rows   [][][]interface{}
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err, string(data))
+	}
+	if decoded.Width != 3 || decoded.Height != 2 || len(decoded.Rows) != 2 {
+		t.Fatal("Unexpected grid:", string(data))
+	}
+	expected := []interface{}{"<", float64(15), float64(4), float64(CACA_STYLE_BOLD)}
+	if cell := decoded.Rows[0][1]; !reflect.DeepEqual(cell, expected) {
+		t.Error("Unexpected cell:", cell)
+	}
+	if cell := decoded.Rows[1][1]; cell[0] != "" {
+		t.Error("Expected empty char for fullwidth continuation:", cell)
+	}
+}
+
+func TestCacaGridBinary(t *testing.T) {
+	grid := testGrid()
+	data, err := grid.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 4+len(grid.Cells)*cacaCellSize {
+		t.Error("Unexpected length:", len(data))
+	}
+	decoded := new(CacaGrid)
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, grid) {
+		t.Error("Round trip failed:", decoded)
+	}
+	if decoded.Cell(0, 1).Char != '字' || decoded.Row(1)[2].Char != ' ' {
+		t.Error("Unexpected cells:", decoded.Row(1))
+	}
+	if err := decoded.UnmarshalBinary(data[:len(data)-1]); err != ErrMalformedGrid {
+		t.Error("Expected malformed grid error:", err)
+	}
+}
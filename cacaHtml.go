@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// The htmlclass format is one <pre> with a line per row. Colors and styles
+// are CSS classes defined once in public/css/caca.css instead of inline
+// styles repeated for every run, so frames are a fraction of the size of
+// htmldiv:
+//
+//   f0..ff  foreground ANSI color
+//   b0..bf  background ANSI color
+//   sb si su sk  bold, italics, underline, blink
+//
+// Runs with the default colors and no style are not wrapped in a span.
+
+const hexDigits = "0123456789abcdef"
+
+// writeClasses writes the classes of cell, and returns false if it has none.
+func writeClasses(buf *bytes.Buffer, cell CacaCell) bool {
+	start := buf.Len()
+	add := func(class ...byte) {
+		if buf.Len() > start {
+			buf.WriteByte(' ')
+		}
+		buf.Write(class)
+	}
+	if cell.Fg < 0x10 {
+		add('f', hexDigits[cell.Fg])
+	}
+	if cell.Bg < 0x10 {
+		add('b', hexDigits[cell.Bg])
+	}
+	for i, class := range []byte{'b', 'i', 'u', 'k'} {
+		if cell.Attr&(1<<uint(i)) != 0 {
+			add('s', class)
+		}
+	}
+	return buf.Len() > start
+}
+
+func writeHtmlChar(buf *bytes.Buffer, char rune) {
+	switch {
+	case char == 0:
+		// right half of a fullwidth char
+	case char <= 0x20 || (char >= 0x7f && char <= 0xa0):
+		buf.WriteString("&#160;")
+	case char == '&':
+		buf.WriteString("&amp;")
+	case char == '<':
+		buf.WriteString("&lt;")
+	case char == '>':
+		buf.WriteString("&gt;")
+	case char == '"':
+		buf.WriteString("&quot;")
+	case char == '\'':
+		buf.WriteString("&#39;")
+	case !utf8.ValidRune(char) || char&0xfffe == 0xfffe:
+		buf.WriteRune(utf8.RuneError)
+	default:
+		buf.WriteRune(char)
+	}
+}
+
+// HtmlClass exports the grid in the htmlclass format.
+func (this *CacaGrid) HtmlClass() []byte {
+	var buf bytes.Buffer
+	buf.Grow(32 + len(this.Cells)*2)
+	buf.WriteString(`<pre class="caca">`)
+	for y := 0; y < this.Height; y++ {
+		if y > 0 {
+			buf.WriteByte('\n')
+		}
+		row := this.Row(y)
+		for x, length := 0, 0; x < len(row); x += length {
+			cell := row[x]
+			mark := buf.Len()
+			buf.WriteString(`<span class="`)
+			span := writeClasses(&buf, cell)
+			if span {
+				buf.WriteString(`">`)
+			} else {
+				buf.Truncate(mark)
+			}
+			for length = 0; x+length < len(row) && sameStyle(row[x+length], cell); length++ {
+				writeHtmlChar(&buf, row[x+length].Char)
+			}
+			if span {
+				buf.WriteString("</span>")
+			}
+		}
+	}
+	buf.WriteString("</pre>")
+	return buf.Bytes()
+}
+
+func sameStyle(a CacaCell, b CacaCell) bool {
+	return a.Fg == b.Fg && a.Bg == b.Bg && a.Attr == b.Attr
+}
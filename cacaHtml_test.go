@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestCacaGridHtmlClass(t *testing.T) {
+	expected := `<pre class="caca"><span class="f7 b0">a</span><span class="ff b4 sb">&lt;</span>&quot;` + "\n" +
+		`<span class="f1 b2 su">字</span><span class="f0 b0">&#160;</span></pre>`
+	if html := string(testGrid().HtmlClass()); html != expected {
+		t.Errorf("Unexpected html:\n%s\nexpected:\n%s", html, expected)
+	}
+
+	grid := NewCacaGrid(2, 1)
+	grid.Cells[0] = CacaCell{0xd800, CACA_DEFAULT, CACA_DEFAULT, 0}
+	grid.Cells[1] = CacaCell{0xfffe, CACA_DEFAULT, CACA_DEFAULT, 0}
+	if html := string(grid.HtmlClass()); html != `<pre class="caca">`+"��</pre>" {
+		t.Error("Expected replacement chars:", html)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestCacaExportFormats(t *testing.T) {
+	canvas := NewCacaCanvas(8, 4)
+	defer canvas.Free()
+
+	for _, option := range CacaExportFormats() {
+		format, err := ParseCacaExportFormat(option.Name)
+		if err != nil || format.String() != option.Name {
+			t.Error("Cannot parse format:", option.Name, err)
+			continue
+		}
+		if _, err := canvas.ExportTo(format); err != nil {
+			t.Error("Cannot export format:", option.Name, err)
+		}
+	}
+	for _, name := range []string{"utf8", "svg", "troff"} {
+		if _, err := ParseCacaExportFormat(name); err != nil {
+			t.Error("Missing libcaca format:", name)
+		}
+	}
+	if _, err := canvas.ExportTo(CacaExportFormat(len(CacaExportFormats()))); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+}
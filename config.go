@@ -1,22 +1,325 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 var (
 	config struct {
-		GoEnv         string
-		ResourcesPath string
-		PublicPath    string
-		WebsocketHost string
-		ListenPort    string
+		GoEnv            string
+		ResourcesPath    string
+		PublicPath       string
+		WebsocketHost    string
+		ListenPort       string
+		ColumnWidths     []int // renditions the server produces and caches
+		DefaultColumns   int
+		MinColumns       int // limits on what clients may ask for
+		MaxColumns       int
+		Profiles         map[string]*RenderProfile
+		MovieProfiles    map[string]string // movie id -> default profile name
+		DefaultCodec     string            // frame compression unless a movie sets its own
+		MovieCodecs      map[string]string // movie id -> codec name
+		KeyframeInterval int               // frames between stored keyframes, 1 to store no deltas
+		LockTimeout      int               // seconds to wait for another replica's cache build
 	}
 )
 
-func loadConfig() {
-	config.ResourcesPath = os.ExpandEnv("./resources")
-	config.PublicPath = os.ExpandEnv("./public")
+// configKey describes one setting that can come from config.json, the
+// environment or the command line, in increasing order of precedence.
+// Environment and command line values are passed to Set as JSON strings.
+type configKey struct {
+	Name string // key in config.json, also used as the flag name
+	Env  string
+	Set  func(raw json.RawMessage) error
+}
+
+func configKeys() []*configKey {
+	return []*configKey{
+		{"resourcesPath", "RESOURCES_PATH", stringSetter(&config.ResourcesPath)},
+		{"publicPath", "PUBLIC_PATH", stringSetter(&config.PublicPath)},
+		{"websocketHost", "WEBSOCKET_HOST", stringSetter(&config.WebsocketHost)},
+		{"listenPort", "LISTEN_PORT", setConfigPort},
+		{"columnWidths", "COLUMN_WIDTHS", intListSetter(&config.ColumnWidths)},
+		{"defaultColumns", "DEFAULT_COLUMNS", intSetter(&config.DefaultColumns)},
+		{"minColumns", "MIN_COLUMNS", intSetter(&config.MinColumns)},
+		{"maxColumns", "MAX_COLUMNS", intSetter(&config.MaxColumns)},
+		{"profiles", "PROFILES", jsonSetter(&config.Profiles)},
+		{"movieProfiles", "MOVIE_PROFILES", jsonSetter(&config.MovieProfiles)},
+		{"defaultCodec", "DEFAULT_CODEC", stringSetter(&config.DefaultCodec)},
+		{"movieCodecs", "MOVIE_CODECS", jsonSetter(&config.MovieCodecs)},
+		{"keyframeInterval", "KEYFRAME_INTERVAL", intSetter(&config.KeyframeInterval)},
+		{"lockTimeout", "LOCK_TIMEOUT", intSetter(&config.LockTimeout)},
+	}
+}
+
+func parseConfigString(raw json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", errors.New("Expect a string")
+	}
+	return s, nil
+}
+
+// ints are accepted either as "120" or as 120
+func parseConfigInt(raw json.RawMessage) (int, error) {
+	var n int
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n, nil
+	}
+	s, err := parseConfigString(raw)
+	if err != nil {
+		return 0, errors.New("Expect an integer or string")
+	}
+	if n, err = strconv.Atoi(strings.TrimSpace(s)); err != nil {
+		return 0, errors.New("Invalid integer: " + s)
+	}
+	return n, nil
+}
+
+func stringSetter(value *string) func(raw json.RawMessage) error {
+	return func(raw json.RawMessage) error {
+		s, err := parseConfigString(raw)
+		if err != nil {
+			return err
+		}
+		*value = os.Expand(s, expandConfigVar)
+		return nil
+	}
+}
+
+func intSetter(value *int) func(raw json.RawMessage) error {
+	return func(raw json.RawMessage) error {
+		n, err := parseConfigInt(raw)
+		if err != nil {
+			return err
+		}
+		*value = n
+		return nil
+	}
+}
+
+// int lists are accepted either as "60,120" or as [60, 120]
+func intListSetter(value *[]int) func(raw json.RawMessage) error {
+	return func(raw json.RawMessage) error {
+		var list []json.RawMessage
+		if err := json.Unmarshal(raw, &list); err != nil {
+			s, err := parseConfigString(raw)
+			if err != nil {
+				return errors.New("Expect a list of integers or string")
+			}
+			list = nil
+			for _, item := range strings.Split(s, ",") {
+				itemRaw, _ := json.Marshal(item)
+				list = append(list, itemRaw)
+			}
+		}
+		ns := make([]int, 0, len(list))
+		for _, item := range list {
+			n, err := parseConfigInt(item)
+			if err != nil {
+				return err
+			}
+			ns = append(ns, n)
+		}
+		*value = ns
+		return nil
+	}
+}
+
+// strictUnmarshal is json.Unmarshal, but rejects unknown fields.
+func strictUnmarshal(content []byte, value interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.DisallowUnknownFields()
+	return dec.Decode(value)
+}
+
+// objects are accepted either as JSON or as a string holding JSON
+func jsonSetter(value interface{}) func(raw json.RawMessage) error {
+	return func(raw json.RawMessage) error {
+		if s, err := parseConfigString(raw); err == nil {
+			raw = json.RawMessage(s)
+		}
+		return strictUnmarshal(raw, value)
+	}
+}
+
+// listenPort is accepted either as "8080" or as 8080
+func setConfigPort(raw json.RawMessage) error {
+	n, err := parseConfigInt(raw)
+	if err != nil {
+		return errors.New("Expect a port number or string")
+	}
+	if n <= 0 || n > 65535 {
+		return fmt.Errorf("Invalid port: %d", n)
+	}
+	config.ListenPort = strconv.Itoa(n)
+	return nil
+}
+
+// expandConfigVar expands $VAR references, falling back to go's default
+// GOPATH when it is not set in the environment.
+func expandConfigVar(name string) string {
+	if v := os.Getenv(name); v != "" || name != "GOPATH" {
+		return v
+	}
+	return build.Default.GOPATH
+}
+
+func setConfigValue(key *configKey, raw json.RawMessage, source string) error {
+	if err := key.Set(raw); err != nil {
+		return fmt.Errorf("Malformed config key %q in %s: %v", key.Name, source, err)
+	}
+	return nil
+}
+
+func loadConfigFile(path string, keys map[string]*configKey) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(content, &values); err != nil {
+		return fmt.Errorf("Malformed config file %s: %v", path, err)
+	}
+	for name, raw := range values {
+		key, ok := keys[name]
+		if !ok {
+			return fmt.Errorf("Unknown config key %q in %s", name, path)
+		}
+		if err := setConfigValue(key, raw, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateConfig() error {
+	if config.MinColumns <= 0 || config.MinColumns > config.MaxColumns {
+		return fmt.Errorf("Invalid column limits: %d-%d", config.MinColumns, config.MaxColumns)
+	}
+	if len(config.ColumnWidths) == 0 {
+		return errors.New("No column widths configured")
+	}
+	sort.Ints(config.ColumnWidths)
+	for _, cols := range config.ColumnWidths {
+		if cols < config.MinColumns || cols > config.MaxColumns {
+			return fmt.Errorf("Column width %d outside of limits %d-%d", cols, config.MinColumns, config.MaxColumns)
+		}
+	}
+	config.DefaultColumns = nearestColumnWidth(config.DefaultColumns)
+	for name, profile := range config.Profiles {
+		if err := profile.Validate(); err != nil {
+			return fmt.Errorf("Invalid profile %q: %v", name, err)
+		}
+	}
+	for movieId, name := range config.MovieProfiles {
+		if _, err := getRenderProfile(name); err != nil {
+			return fmt.Errorf("Invalid profile for movie %q: %v", movieId, err)
+		}
+	}
+	if config.KeyframeInterval < 1 {
+		return fmt.Errorf("Invalid keyframe interval: %d", config.KeyframeInterval)
+	}
+	if _, err := GetFrameCodec(config.DefaultCodec); err != nil {
+		return err
+	}
+	for movieId, name := range config.MovieCodecs {
+		if _, err := GetFrameCodec(name); err != nil {
+			return fmt.Errorf("Invalid codec for movie %q: %v", movieId, err)
+		}
+	}
+	return nil
+}
+
+// nearestColumnWidth picks the configured width closest to cols, preferring
+// the narrower one on ties.
+func nearestColumnWidth(cols int) int {
+	best := config.ColumnWidths[0]
+	for _, width := range config.ColumnWidths {
+		if abs(width-cols) < abs(best-cols) {
+			best = width
+		}
+	}
+	return best
+}
+
+// loadConfig reads config/<GO_ENV>/config.json, then applies environment
+// variable and command line overrides from args.
+func loadConfig(args []string) error {
+	config.GoEnv = os.Getenv("GO_ENV")
+	config.ResourcesPath = "./resources"
+	config.PublicPath = "./public"
 	config.WebsocketHost = "localhost:8080"
 	config.ListenPort = "8080"
+	config.ColumnWidths = []int{120}
+	config.DefaultColumns = 120
+	config.MinColumns = 20
+	config.MaxColumns = 400
+	config.Profiles = nil
+	config.MovieProfiles = nil
+	config.DefaultCodec = defaultCodecName
+	config.MovieCodecs = nil
+	config.KeyframeInterval = 50
+	config.LockTimeout = 30 * 60
+
+	all := configKeys()
+	keys := make(map[string]*configKey)
+	flags := flag.NewFlagSet("go-ascii-server", flag.ContinueOnError)
+	envFlag := flags.String("env", "", "environment name, overrides GO_ENV")
+	fileFlag := flags.String("config", "", "config file, defaults to config/<env>/config.json")
+	flagValues := make(map[string]*string)
+	for _, key := range all {
+		keys[key.Name] = key
+		flagValues[key.Name] = flags.String(key.Name, "", "overrides "+key.Name+" in config file")
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *envFlag != "" {
+		config.GoEnv = *envFlag
+	}
+	if config.GoEnv == "" {
+		config.GoEnv = "dev"
+	}
+	configPath := *fileFlag
+	if configPath == "" {
+		configPath = filepath.Join("config", config.GoEnv, "config.json")
+	}
+	log.Println("Loading config:", configPath)
+	if err := loadConfigFile(configPath, keys); err != nil {
+		return err
+	}
+
+	for _, key := range all {
+		if v := os.Getenv(key.Env); v != "" {
+			raw, _ := json.Marshal(v)
+			if err := setConfigValue(key, raw, "environment variable "+key.Env); err != nil {
+				return err
+			}
+		}
+	}
+	var flagErr error
+	flags.Visit(func(f *flag.Flag) {
+		if key, ok := keys[f.Name]; ok && flagErr == nil {
+			raw, _ := json.Marshal(*flagValues[f.Name])
+			flagErr = setConfigValue(key, raw, "flag -"+f.Name)
+		}
+	})
+	if flagErr != nil {
+		return flagErr
+	}
+	return validateConfig()
 }
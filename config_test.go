@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setTestEnv sets an environment variable, and returns a function that
+// restores its previous value.
+func setTestEnv(key string, value string) func() {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeTestConfig(t, `{
+		"resourcesPath" : "$TEST_CONFIG_ROOT/resources",
+		"listenPort" : 9090,
+		"columnWidths" : [200, 60, "120"],
+		"defaultColumns" : 100,
+		"profiles" : { "color" : { "algorithm" : "fstein", "color" : "full16" } },
+		"movieProfiles" : { "demo" : "color" },
+		"movieCodecs" : { "demo" : "zstd" }
+	}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer setTestEnv("TEST_CONFIG_ROOT", "/srv")()
+	defer setTestEnv("WEBSOCKET_HOST", "example.com")()
+
+	if err := loadConfig([]string{"-config", path, "-publicPath", "/srv/public"}); err != nil {
+		t.Fatal(err)
+	}
+	if config.ResourcesPath != "/srv/resources" {
+		t.Error("Unexpected resourcesPath:", config.ResourcesPath)
+	}
+	if config.ListenPort != "9090" {
+		t.Error("Unexpected listenPort:", config.ListenPort)
+	}
+	if config.WebsocketHost != "example.com" {
+		t.Error("Unexpected websocketHost:", config.WebsocketHost)
+	}
+	if config.PublicPath != "/srv/public" {
+		t.Error("Unexpected publicPath:", config.PublicPath)
+	}
+	if len(config.ColumnWidths) != 3 || config.ColumnWidths[0] != 60 || config.ColumnWidths[2] != 200 {
+		t.Error("Unexpected columnWidths:", config.ColumnWidths)
+	}
+	if config.DefaultColumns != 120 {
+		t.Error("Unexpected defaultColumns:", config.DefaultColumns)
+	}
+	if movieCodecName("demo") != "zstd" || movieCodecName("other") != defaultCodecName {
+		t.Error("Unexpected codecs:", config.MovieCodecs)
+	}
+	if profile, err := getRenderProfile(movieProfileName("demo")); err != nil {
+		t.Error(err)
+	} else if profile.Algorithm != "fstein" || profile.Charset != DefaultRenderProfile.Charset {
+		t.Error("Unexpected profile:", profile)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, content := range []string{
+		`{"resourcePath": "./resources"}`,
+		`{"listenPort": 80.5}`,
+		`{"listenPort": "http"}`,
+		`{"publicPath": 1}`,
+		`{"publicPath": `,
+		`{"columnWidths": [60, "wide"]}`,
+		`{"columnWidths": [10]}`,
+		`{"columnWidths": []}`,
+		`{"profiles": {"color": {"colour": "full16"}}}`,
+		`{"profiles": {"color": {"algorithm": "sharpen"}}}`,
+		`{"profiles": {"color": {"gamma": 0}}}`,
+		`{"profiles": {"color": {"gamma": -1.5}}}`,
+		`{"profiles": {"color": {"scaler": "sharpen"}}}`,
+		`{"profiles": {"color": {"scaler": ""}}}`,
+		`{"movieProfiles": {"demo": "missing"}}`,
+		`{"keyframeInterval": 0}`,
+		`{"defaultCodec": "brotli"}`,
+		`{"movieCodecs": {"demo": "brotli"}}`,
+	} {
+		path := writeTestConfig(t, content)
+		if err := loadConfig([]string{"-config", path}); err == nil {
+			t.Error("Expected error for config:", content)
+		}
+		os.RemoveAll(filepath.Dir(path))
+	}
+}
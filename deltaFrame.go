@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// Consecutive frames differ in few rows, so most frames are stored as a
+// delta against the frame before: the rows that changed, as JSON. A frame is
+// split into rows on a separator that depends on the export format. Joining
+// the rows again gives back the exact frame, whatever the format. A keyframe
+// is stored every KeyframeInterval frames, and whenever a delta would not be
+// smaller than the frame itself.
+
+type FrameDelta struct {
+	Separator string
+	Rows      int      // number of rows in the resulting frame
+	Index     []int    // rows that changed
+	Content   []string // new content of the rows in Index
+}
+
+var ErrMalformedDelta = errors.New("Malformed frame delta")
+
+// rowSeparator returns what separates the rows of a frame in format.
+func rowSeparator(format CacaExportFormat) string {
+	if format == CACA_EXPORT_FMT_HTMLDIV {
+		return "<br/>"
+	}
+	return "\n"
+}
+
+func diffRows(separator string, previous, current []string) *FrameDelta {
+	delta := &FrameDelta{Separator: separator, Rows: len(current), Index: []int{}, Content: []string{}}
+	for i, row := range current {
+		if i >= len(previous) || previous[i] != row {
+			delta.Index = append(delta.Index, i)
+			delta.Content = append(delta.Content, row)
+		}
+	}
+	return delta
+}
+
+// Apply returns the rows of the frame after previous.
+func (this *FrameDelta) Apply(previous []string) ([]string, error) {
+	if this.Rows < 0 || len(this.Index) != len(this.Content) {
+		return nil, ErrMalformedDelta
+	}
+	rows := make([]string, this.Rows)
+	copy(rows, previous)
+	for i, row := range this.Index {
+		if row < 0 || row >= this.Rows {
+			return nil, ErrMalformedDelta
+		}
+		rows[row] = this.Content[i]
+	}
+	return rows, nil
+}
+
+func decodeFrameDelta(content []byte) (*FrameDelta, error) {
+	delta := new(FrameDelta)
+	if err := json.Unmarshal(content, delta); err != nil {
+		return nil, ErrMalformedDelta
+	}
+	return delta, nil
+}
+
+// DeltaEncoder turns a sequence of frames into keyframes and deltas.
+type DeltaEncoder struct {
+	separator string
+	interval  int // frames from one keyframe to the next, 1 or less for keyframes only
+	previous  []string
+	count     int // frames since the last keyframe
+}
+
+func NewDeltaEncoder(format CacaExportFormat, interval int) *DeltaEncoder {
+	return &DeltaEncoder{separator: rowSeparator(format), interval: interval}
+}
+
+// Encode returns what to store for the next frame, and whether it is a
+// keyframe.
+func (this *DeltaEncoder) Encode(frame string) ([]byte, bool, error) {
+	rows := strings.Split(frame, this.separator)
+	previous := this.previous
+	this.previous = rows
+	this.count++
+
+	// JSON strings cannot carry invalid UTF-8 unchanged
+	if previous == nil || this.count >= this.interval || !utf8.ValidString(frame) {
+		this.count = 0
+		return []byte(frame), true, nil
+	}
+	content, err := json.Marshal(diffRows(this.separator, previous, rows))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(content) >= len(frame) {
+		this.count = 0
+		return []byte(frame), true, nil
+	}
+	return content, false, nil
+}
+
+// frameAssembler rebuilds complete frames from the keyframes and deltas of a
+// rendition, for clients that cannot apply deltas, and to start streaming
+// at a frame that is not a keyframe.
+type frameAssembler struct {
+	rendition  *Rendition
+	rows       []string
+	separator  string
+	generation int // of the store rows and sent were read from
+	last       int // index of the frame in rows, -1 if none
+	sent       int // index of the last frame passed to the client, -1 if none
+}
+
+// errStoreReplaced tells that frames of another store than the one being
+// assembled were read.
+var errStoreReplaced = errors.New("Frame store replaced")
+
+func newFrameAssembler(rendition *Rendition, format CacaExportFormat) *frameAssembler {
+	return &frameAssembler{rendition: rendition, separator: rowSeparator(format), generation: -1, last: -1, sent: -1}
+}
+
+// Next returns what to send to a client for frame i, read from the store of
+// the given generation. Deltas are passed on only if the client applies them
+// and has been sent the frame before from the same store, anything else is
+// sent as a keyframe.
+func (this *frameAssembler) Next(i int, generation int, frame StoredFrame, deltas bool) (StoredFrame, error) {
+	for {
+		if generation != this.generation {
+			// the rows of a replaced store may differ
+			this.generation, this.last, this.sent = generation, -1, -1
+		}
+		if frame.Keyframe || (deltas && this.sent >= 0 && this.sent == i-1) {
+			break
+		}
+		completed, err := this.Complete(i, frame)
+		if err == errStoreReplaced {
+			// read the frame again from the new store
+			if frame, generation, err = this.rendition.ReadFrame(i, false, nil); err != nil {
+				return StoredFrame{}, err
+			}
+			continue
+		} else if err != nil {
+			return StoredFrame{}, err
+		}
+		frame = completed
+		break
+	}
+	this.sent = i
+	return frame, nil
+}
+
+// Complete returns frame i as a keyframe. frame is what is stored for it.
+func (this *frameAssembler) Complete(i int, frame StoredFrame) (StoredFrame, error) {
+	codec, err := GetFrameCodecById(frame.Codec)
+	if err != nil {
+		return StoredFrame{}, err
+	}
+	if frame.Keyframe {
+		// remember where deltas of the following frames apply
+		if err := this.apply(i, codec, frame); err != nil {
+			return StoredFrame{}, err
+		}
+		return frame, nil
+	}
+
+	if this.last != i-1 {
+		if err := this.rebuild(i - 1); err != nil {
+			return StoredFrame{}, err
+		}
+	}
+	if err := this.apply(i, codec, frame); err != nil {
+		return StoredFrame{}, err
+	}
+	payload, err := codec.Encode([]byte(strings.Join(this.rows, this.separator)))
+	if err != nil {
+		return StoredFrame{}, err
+	}
+	return StoredFrame{payload, frame.Timestamp, frame.Codec, true}, nil
+}
+
+// apply updates rows to frame i, which follows the frame in rows unless it
+// is a keyframe.
+func (this *frameAssembler) apply(i int, codec FrameCodec, frame StoredFrame) error {
+	content, err := codec.Decode(frame.Payload)
+	if err != nil {
+		return err
+	}
+	if frame.Keyframe {
+		this.rows = strings.Split(string(content), this.separator)
+		this.last = i
+		return nil
+	}
+	delta, err := decodeFrameDelta(content)
+	if err != nil {
+		return err
+	}
+	if this.rows, err = delta.Apply(this.rows); err != nil {
+		return err
+	}
+	this.last = i
+	return nil
+}
+
+// rebuild brings rows to frame i, starting from the keyframe before it.
+func (this *frameAssembler) rebuild(i int) error {
+	var frames []StoredFrame
+	first := i
+	for ; first >= 0; first-- {
+		frame, generation, err := this.rendition.ReadFrame(first, false, nil)
+		if err != nil {
+			return err
+		}
+		if generation != this.generation {
+			return errStoreReplaced
+		}
+		frames = append(frames, frame)
+		if frame.Keyframe {
+			break
+		}
+	}
+	if first < 0 {
+		return errors.New("No keyframe before frame")
+	}
+	for j := len(frames) - 1; j >= 0; j-- {
+		codec, err := GetFrameCodecById(frames[j].Codec)
+		if err != nil {
+			return err
+		}
+		if err := this.apply(i-j, codec, frames[j]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
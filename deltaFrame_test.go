@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeltaEncoderRoundTrip(t *testing.T) {
+	frames := []string{
+		"aaaa\nbbbb\ncccc\ndddd",
+		"aaaa\nbxbb\ncccc\ndddd",
+		"aaaa\nbxbb\ncccc\ndddd",
+		"aaaa\nbxbb\ncccc",
+		"aaaa\nbxbb\ncccc\ndddd\neeee",
+		"aaaa\nbbbb\ncccc\ndxdd\neeee",
+	}
+	// rows long enough for deltas to be worth it
+	for i, frame := range frames {
+		frames[i] = strings.Replace(frame, "\n", strings.Repeat(".", 40)+"\n", -1)
+	}
+	encoder := NewDeltaEncoder(CACA_EXPORT_FMT_ANSI, 4)
+	var rows []string
+	for i, frame := range frames {
+		content, keyframe, err := encoder.Encode(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := i%4 == 0; keyframe != expected {
+			t.Errorf("Frame %d: expected keyframe %v", i, expected)
+		}
+		if keyframe {
+			rows = strings.Split(string(content), "\n")
+		} else {
+			delta, err := decodeFrameDelta(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rows, err = delta.Apply(rows); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if decoded := strings.Join(rows, "\n"); decoded != frame {
+			t.Errorf("Frame %d: expected %q, got %q", i, frame, decoded)
+		}
+	}
+}
+
+func TestDeltaEncoderFallsBackToKeyframes(t *testing.T) {
+	encoder := NewDeltaEncoder(CACA_EXPORT_FMT_HTMLDIV, 50)
+	encoder.Encode("a<br/>b")
+	// every row changes, the delta is larger than the frame
+	if _, keyframe, _ := encoder.Encode("c<br/>d"); !keyframe {
+		t.Error("Expected keyframe when the delta is not smaller")
+	}
+	encoder.Encode(strings.Repeat("row<br/>", 20))
+	if _, keyframe, _ := encoder.Encode(strings.Repeat("row<br/>", 20) + "\xff"); !keyframe {
+		t.Error("Expected keyframe for invalid UTF-8")
+	}
+}
+
+func TestFrameDeltaMalformed(t *testing.T) {
+	for _, content := range []string{
+		`{"Rows": 2, "Index": [2], "Content": ["x"]}`,
+		`{"Rows": 2, "Index": [0, 1], "Content": ["x"]}`,
+		`{"Rows": -1}`,
+	} {
+		delta, err := decodeFrameDelta([]byte(content))
+		if err == nil {
+			_, err = delta.Apply([]string{"a", "b"})
+		}
+		if err != ErrMalformedDelta {
+			t.Error("Expected malformed delta:", content, err)
+		}
+	}
+	if _, err := decodeFrameDelta([]byte("not json")); err != ErrMalformedDelta {
+		t.Error("Expected malformed delta for invalid JSON")
+	}
+}
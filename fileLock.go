@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	lockLeaseDuration = 2 * time.Minute
+	lockPollInterval  = 500 * time.Millisecond
+)
+
+var (
+	ErrLockTimeout      = errors.New("Timed out waiting for lock")
+	errFlockUnsupported = errors.New("flock is not supported")
+)
+
+// lockOwner is written into every lock file, so a lock left behind by a
+// crashed process can be recognized.
+type lockOwner struct {
+	Pid       int
+	Hostname  string
+	Timestamp time.Time // refreshed while the lock is held
+}
+
+func currentLockOwner() lockOwner {
+	hostname, _ := os.Hostname()
+	return lockOwner{Pid: os.Getpid(), Hostname: hostname, Timestamp: time.Now()}
+}
+
+// staleReason tells why the lock held by owner can be taken over, or returns
+// "" if its owner may still be alive.
+func (this *lockOwner) staleReason() string {
+	hostname, _ := os.Hostname()
+	if this.Hostname == hostname && !processAlive(this.Pid) {
+		return fmt.Sprintf("owner process %d is dead", this.Pid)
+	}
+	if time.Since(this.Timestamp) > lockLeaseDuration {
+		return fmt.Sprintf("lease of %s:%d expired at %s", this.Hostname, this.Pid, this.Timestamp.Add(lockLeaseDuration))
+	}
+	return ""
+}
+
+// FileLock guards <file>.lock. Where the platform supports it the lock is
+// an flock, which the kernel releases when the owner dies. Otherwise the
+// lock file is created exclusively and holds a lease that the owner keeps
+// renewing, so a dead owner's lock expires.
+type FileLock struct {
+	path  string
+	file  *os.File
+	flock bool
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// AcquireFileLock locks filePath, waiting up to timeout for another owner to
+// release it.
+func AcquireFileLock(filePath string, timeout time.Duration) (*FileLock, error) {
+	return acquireFileLock(filePath, timeout, true)
+}
+
+func acquireFileLock(filePath string, timeout time.Duration, useFlock bool) (*FileLock, error) {
+	dir, file := filepath.Split(filePath)
+	if file == "" {
+		return nil, errors.New("Cannot lock dirs")
+	}
+	if dir != "" {
+		if _, err := os.Stat(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	lock := &FileLock{path: filePath + ".lock", flock: useFlock}
+	deadline := time.Now().Add(timeout)
+	logged := false
+	for {
+		var ok bool
+		var err error
+		if lock.flock {
+			ok, err = lock.tryFlock()
+			if err == errFlockUnsupported {
+				lock.flock = false
+				continue
+			}
+		} else {
+			ok, err = lock.tryCreate()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			return nil, ErrLockTimeout
+		}
+		if !logged {
+			log.Println("Waiting for lock:", lock.path)
+			logged = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	if !lock.flock {
+		lock.stop = make(chan struct{})
+		lock.done = make(chan struct{})
+		go lock.renewLease()
+	}
+	return lock, nil
+}
+
+func (this *FileLock) tryFlock() (bool, error) {
+	file, err := os.OpenFile(this.path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return false, err
+	}
+	ok, err := flockFile(file)
+	if err != nil || !ok {
+		file.Close()
+		return false, err
+	}
+	// the previous owner may have removed the file between our open and
+	// flock, in which case we locked a file nobody else can see
+	opened, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return false, err
+	}
+	current, err := os.Stat(this.path)
+	if err != nil || !os.SameFile(opened, current) {
+		file.Close()
+		return false, nil
+	}
+	this.file = file
+	return true, this.writeOwner()
+}
+
+func (this *FileLock) tryCreate() (bool, error) {
+	file, err := os.OpenFile(this.path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err == nil {
+		this.file = file
+		return true, this.writeOwner()
+	}
+	if !os.IsExist(err) {
+		return false, err
+	}
+
+	// read and stat the same file, the lock may be replaced meanwhile
+	file, err = os.Open(this.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return false, err
+	}
+	content, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return false, err
+	}
+	var owner lockOwner
+	if err := json.Unmarshal(content, &owner); err != nil {
+		// either being written right now, or left behind half written
+		if time.Since(info.ModTime()) < lockLeaseDuration {
+			return false, nil
+		}
+		owner = lockOwner{Timestamp: info.ModTime()}
+	}
+	if reason := owner.staleReason(); reason != "" {
+		log.Println("Removing stale lock:", this.path, reason)
+		if err := this.removeStale(info); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// removeStale removes the lock file if it still is the stale one. Another
+// waiter may have removed it and created a fresh lock since, which removing
+// by name would delete, so the file is moved away and checked first.
+func (this *FileLock) removeStale(stale os.FileInfo) error {
+	moved := fmt.Sprintf("%s.%d.%d.stale", this.path, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(this.path, moved); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info, err := os.Stat(moved); err == nil && !sameLockFile(info, stale) {
+		// put the fresh lock back, unless yet another one was created
+		if err := os.Link(moved, this.path); err != nil && !os.IsExist(err) {
+			return os.Rename(moved, this.path)
+		}
+	}
+	err := os.Remove(moved)
+	if err != nil && os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+// sameLockFile tells whether two stats are of the same lock file. A fresh
+// lock may reuse the inode of a removed one, but not its modification time.
+func sameLockFile(a os.FileInfo, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+func (this *FileLock) writeOwner() error {
+	content, err := json.Marshal(currentLockOwner())
+	if err != nil {
+		return err
+	}
+	if err := this.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = this.file.WriteAt(content, 0)
+	return err
+}
+
+func (this *FileLock) renewLease() {
+	defer close(this.done)
+	ticker := time.NewTicker(lockLeaseDuration / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := this.writeOwner(); err != nil {
+				log.Println("Cannot renew lock:", this.path, err)
+			}
+		case <-this.stop:
+			return
+		}
+	}
+}
+
+// Release removes the lock file and unlocks it.
+func (this *FileLock) Release() error {
+	if this.stop != nil {
+		close(this.stop)
+		<-this.done
+	}
+	err := os.Remove(this.path)
+	if err != nil && os.IsNotExist(err) {
+		err = nil
+	}
+	// closing the file drops the flock
+	if closeErr := this.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
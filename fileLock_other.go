@@ -0,0 +1,15 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import "os"
+
+func flockFile(file *os.File) (bool, error) {
+	return false, errFlockUnsupported
+}
+
+// processAlive cannot tell, so only lease expiry detects dead owners.
+func processAlive(pid int) bool {
+	return true
+}
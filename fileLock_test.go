@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileLockExcludes(t *testing.T) {
+	for _, useFlock := range []bool{true, false} {
+		dir, err := ioutil.TempDir("", "filelock")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "movie.cache")
+
+		lock, err := acquireFileLock(path, 0, useFlock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := acquireFileLock(path, time.Second, useFlock); err != ErrLockTimeout {
+			t.Error("Expected timeout while locked, got:", err)
+		}
+
+		released := make(chan error)
+		go func(lock *FileLock) {
+			time.Sleep(100 * time.Millisecond)
+			released <- lock.Release()
+		}(lock)
+		next, err := acquireFileLock(path, 5*time.Second, useFlock)
+		if err != nil {
+			t.Fatal("Waiting for release failed:", err)
+		}
+		if err := <-released; err != nil {
+			t.Error(err)
+		}
+		next.Release()
+	}
+}
+
+func writeLockOwner(t *testing.T, path string, owner lockOwner) {
+	content, _ := json.Marshal(owner)
+	if err := ioutil.WriteFile(path+".lock", content, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileLockRecoversStaleLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filelock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "movie.cache")
+	hostname, _ := os.Hostname()
+
+	// a live owner with a fresh lease keeps the lock
+	writeLockOwner(t, path, lockOwner{os.Getpid(), hostname, time.Now()})
+	if _, err := acquireFileLock(path, time.Second, false); err != ErrLockTimeout {
+		t.Error("Expected timeout, got:", err)
+	}
+
+	for _, owner := range []lockOwner{
+		{1 << 22, hostname, time.Now()},                                    // dead process on this host
+		{os.Getpid(), "elsewhere", time.Now().Add(-2 * lockLeaseDuration)}, // expired lease
+	} {
+		writeLockOwner(t, path, owner)
+		lock, err := acquireFileLock(path, 5*time.Second, false)
+		if err != nil {
+			t.Error("Stale lock not recovered:", owner, err)
+			continue
+		}
+		lock.Release()
+	}
+}
+
+func TestFileLockStaleRemovalKeepsFreshLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filelock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "movie.cache")
+	hostname, _ := os.Hostname()
+
+	// a waiter judged the lock stale, and another one replaced it before
+	// the first got to remove it
+	writeLockOwner(t, path, lockOwner{1 << 22, hostname, time.Now()})
+	stale, err := os.Stat(path + ".lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(path + ".lock")
+	fresh, err := acquireFileLock(path, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Release()
+	lock := &FileLock{path: path + ".lock"}
+	if err := lock.removeStale(stale); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path + ".lock"); err != nil || !os.SameFile(info, mustStat(t, fresh.file)) {
+		t.Error("Fresh lock removed:", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.stale")); len(files) != 0 {
+		t.Error("Moved lock left behind:", files)
+	}
+}
+
+func mustStat(t *testing.T, file *os.File) os.FileInfo {
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestFileLockConcurrentWaitersOnStaleLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filelock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "movie.cache")
+	hostname, _ := os.Hostname()
+	writeLockOwner(t, path, lockOwner{1 << 22, hostname, time.Now()})
+
+	var mutex sync.Mutex
+	holders := 0
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			lock, err := acquireFileLock(path, 10*time.Second, false)
+			if err != nil {
+				errs <- err
+				return
+			}
+			mutex.Lock()
+			holders++
+			both := holders > 1
+			mutex.Unlock()
+			time.Sleep(lockPollInterval * 2)
+			mutex.Lock()
+			holders--
+			mutex.Unlock()
+			if both {
+				err = errors.New("Both waiters hold the lock")
+			}
+			if releaseErr := lock.Release(); err == nil {
+				err = releaseErr
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// FrameCodec compresses converted frames before they are stored. Frames are
+// sent to clients as stored, so clients decompress them with the codec
+// named in each frame.
+type FrameCodec interface {
+	Name() string
+	Id() byte // stored in the frame store index and sent in binary frames
+	Encode(frame []byte) ([]byte, error)
+	Decode(payload []byte) ([]byte, error)
+}
+
+// gzip is what clients got before codecs could be chosen
+const defaultCodecName = "gzip"
+
+var frameCodecs = []FrameCodec{
+	noneCodec{},
+	gzipCodec{},
+	deflateCodec{},
+	lz4Codec{},
+	zstdCodec{},
+}
+
+func GetFrameCodec(name string) (FrameCodec, error) {
+	for _, codec := range frameCodecs {
+		if codec.Name() == name {
+			return codec, nil
+		}
+	}
+	return nil, errors.New("Unsupported codec: " + name)
+}
+
+func GetFrameCodecById(id byte) (FrameCodec, error) {
+	for _, codec := range frameCodecs {
+		if codec.Id() == id {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown codec id: %d", id)
+}
+
+func FrameCodecNames() []string {
+	names := make([]string, len(frameCodecs))
+	for i, codec := range frameCodecs {
+		names[i] = codec.Name()
+	}
+	return names
+}
+
+// movieCodecName returns the codec a movie is stored with unless the client
+// cannot decode it.
+func movieCodecName(movieId string) string {
+	if name, ok := config.MovieCodecs[movieId]; ok {
+		return name
+	}
+	return config.DefaultCodec
+}
+
+// parseCodecList reads a comma separated list of codecs in order of
+// preference, dropping the ones the server does not support.
+func parseCodecList(list string) ([]string, error) {
+	var codecs []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if _, err := GetFrameCodec(name); err == nil {
+			codecs = append(codecs, name)
+		}
+	}
+	if len(codecs) == 0 {
+		return nil, errors.New("No supported codec in: " + list)
+	}
+	return codecs, nil
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string { return "none" }
+func (noneCodec) Id() byte     { return 0 }
+
+func (noneCodec) Encode(frame []byte) ([]byte, error) {
+	return frame, nil
+}
+
+func (noneCodec) Decode(payload []byte) ([]byte, error) {
+	return payload, nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+func (gzipCodec) Id() byte     { return 1 }
+
+func (gzipCodec) Encode(frame []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(frame); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gzipCodec) Decode(payload []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// deflateCodec is raw deflate, gzip without its header and trailer.
+type deflateCodec struct{}
+
+func (deflateCodec) Name() string { return "deflate" }
+func (deflateCodec) Id() byte     { return 2 }
+
+func (deflateCodec) Encode(frame []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(frame); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (deflateCodec) Decode(payload []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(payload))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// lz4Codec writes the LZ4 frame format, which public/js/lz4.min.js reads.
+type lz4Codec struct{}
+
+func (lz4Codec) Name() string { return "lz4" }
+func (lz4Codec) Id() byte     { return 3 }
+
+func (lz4Codec) Encode(frame []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := lz4.NewWriter(&b)
+	if _, err := w.Write(frame); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (lz4Codec) Decode(payload []byte) ([]byte, error) {
+	return ioutil.ReadAll(lz4.NewReader(bytes.NewReader(payload)))
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string { return "zstd" }
+func (zstdCodec) Id() byte     { return 4 }
+
+// zstd encoders and decoders are expensive to create and safe to share
+var (
+	zstdEncoder     *zstd.Encoder
+	zstdDecoder     *zstd.Decoder
+	zstdInitErr     error
+	zstdInitialized sync.Once
+)
+
+func initZstd() error {
+	zstdInitialized.Do(func() {
+		if zstdEncoder, zstdInitErr = zstd.NewWriter(nil); zstdInitErr != nil {
+			return
+		}
+		zstdDecoder, zstdInitErr = zstd.NewReader(nil)
+	})
+	return zstdInitErr
+}
+
+func (zstdCodec) Encode(frame []byte) ([]byte, error) {
+	if err := initZstd(); err != nil {
+		return nil, err
+	}
+	return zstdEncoder.EncodeAll(frame, nil), nil
+}
+
+func (zstdCodec) Decode(payload []byte) ([]byte, error) {
+	if err := initZstd(); err != nil {
+		return nil, err
+	}
+	return zstdDecoder.DecodeAll(payload, nil)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFrameCodecsRoundTrip(t *testing.T) {
+	frame := bytes.Repeat([]byte(`<div style="color:#fff">@@##..  </div>`), 200)
+	ids := make(map[byte]bool)
+	for _, codec := range frameCodecs {
+		if ids[codec.Id()] {
+			t.Error("Duplicate codec id:", codec.Id())
+		}
+		ids[codec.Id()] = true
+
+		payload, err := codec.Encode(frame)
+		if err != nil {
+			t.Error(codec.Name(), err)
+			continue
+		}
+		decoded, err := codec.Decode(payload)
+		if err != nil || !bytes.Equal(decoded, frame) {
+			t.Error("Round trip failed:", codec.Name(), err)
+		}
+		if byId, err := GetFrameCodecById(codec.Id()); err != nil || byId.Name() != codec.Name() {
+			t.Error("Lookup by id failed:", codec.Name(), err)
+		}
+	}
+}
+
+func TestParseCodecList(t *testing.T) {
+	codecs, err := parseCodecList("brotli, zstd,gzip")
+	if err != nil || len(codecs) != 2 || codecs[0] != "zstd" || codecs[1] != "gzip" {
+		t.Error("Unexpected codecs:", codecs, err)
+	}
+	if _, err := parseCodecList("brotli"); err == nil {
+		t.Error("Expected error for unsupported codecs")
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// On-disk frame store. Frames are appended while they are converted, so the
+// header and the frame index are written after the payloads, and the
+// preamble points at them:
+//
+//   preamble  magic[8] version:u32 reserved:u32 footerOffset:u64
+//   payloads  frame payloads, back to back
+//   footer    headerLength:u32 header(JSON) index(frameCount * entry)
+//   entry     offset:u64 length:u32 crc32:u32 timestamp:i64 codec:u8 flags:u8 reserved[2]
+//
+// A store that was never finished has footerOffset 0 and is rejected, as is
+// one whose footer does not end exactly at the end of the file. Payloads are
+// checked against their IEEE CRC-32 whenever they are read. Timestamps are
+// presentation times in microseconds, codec is the FrameCodec id the payload
+// is compressed with. Flag bit 0 marks a delta frame.
+// All integers are little endian.
+
+const FrameStoreVersion = 5
+
+var frameStoreMagic = [8]byte{'A', 'S', 'C', 'I', 'I', 'F', 'S', 0}
+
+const (
+	frameStorePreambleSize = 24
+	frameIndexEntrySize    = 28
+)
+
+var (
+	ErrFrameStoreFormat     = errors.New("Not a frame store")
+	ErrFrameStoreVersion    = errors.New("Unsupported frame store version")
+	ErrFrameStoreIncomplete = errors.New("Frame store was not finished")
+	ErrFrameStoreReadOnly   = errors.New("Frame store is read only")
+	ErrFrameStoreTruncated  = errors.New("Frame store is truncated")
+	ErrFrameChecksum        = errors.New("Frame checksum mismatch")
+)
+
+// FrameStoreMalformedError tells that the footer of a store is damaged.
+type FrameStoreMalformedError struct {
+	Reason string
+}
+
+func (this *FrameStoreMalformedError) Error() string {
+	return "Malformed frame store: " + this.Reason
+}
+
+// IsFrameStoreCorrupt tells whether err means that a store is damaged, as
+// opposed to it being of another format or the file being unreadable.
+func IsFrameStoreCorrupt(err error) bool {
+	if _, ok := err.(*FrameStoreMalformedError); ok {
+		return true
+	}
+	return err == ErrFrameStoreIncomplete || err == ErrFrameStoreTruncated || err == ErrFrameChecksum
+}
+
+type FrameStoreHeader struct {
+	SourceHash       string // sha256 of the source movie
+	SourceSize       int64
+	SourceModTime    int64          // unix nanoseconds
+	Settings         string         // rendition key the frames were rendered with
+	Profile          *RenderProfile // dither options the frames were rendered with
+	Compression      string         // codec the frames were compressed with
+	FrameCount       int
+	FrameRate        float64 // average frames per second, 0 if unknown
+	KeyframeInterval int
+	ImageWidth       int // of the images the frames were dithered from
+	ImageHeight      int
+	SampleRate       int // of audio stores
+	Channels         int
+}
+
+type frameIndexEntry struct {
+	Offset   uint64
+	Length   uint32
+	Checksum uint32
+	Time     int64 // microseconds
+	Codec    uint8
+	Flags    uint8
+	Reserved [2]uint8
+}
+
+const frameFlagDelta = 1
+
+// StoredFrame is a frame as it is kept in a store.
+type StoredFrame struct {
+	Payload   []byte
+	Timestamp time.Duration // when the frame is presented
+	Codec     byte          // id of the FrameCodec the payload is compressed with
+	Keyframe  bool          // false if the payload is a FrameDelta
+}
+
+type FrameStore struct {
+	mutex    sync.RWMutex
+	file     *os.File
+	path     string // final path, the file lives at path + ".tmp" until finished
+	header   FrameStoreHeader
+	index    []frameIndexEntry
+	end      int64
+	writable bool
+	aborted  bool // the unfinished file is removed
+}
+
+// CreateFrameStore starts a new store. Frames can be read back while it is
+// being written, and the store stays readable after Finish.
+func CreateFrameStore(path string, header FrameStoreHeader) (*FrameStore, error) {
+	file, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	var preamble [frameStorePreambleSize]byte
+	copy(preamble[:], frameStoreMagic[:])
+	binary.LittleEndian.PutUint32(preamble[8:], FrameStoreVersion)
+	if _, err := file.Write(preamble[:]); err != nil {
+		file.Close()
+		return nil, err
+	}
+	header.FrameCount = 0
+	return &FrameStore{
+		file:     file,
+		path:     path,
+		header:   header,
+		end:      frameStorePreambleSize,
+		writable: true,
+	}, nil
+}
+
+func OpenFrameStore(path string) (*FrameStore, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	store := &FrameStore{file: file, path: path}
+	if err := store.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (this *FrameStore) load() error {
+	var preamble [frameStorePreambleSize]byte
+	if _, err := this.file.ReadAt(preamble[:], 0); err != nil {
+		if err == io.EOF {
+			return ErrFrameStoreFormat
+		}
+		return err
+	}
+	if !bytes.Equal(preamble[:8], frameStoreMagic[:]) {
+		return ErrFrameStoreFormat
+	}
+	if binary.LittleEndian.Uint32(preamble[8:]) != FrameStoreVersion {
+		return ErrFrameStoreVersion
+	}
+	footerOffset := int64(binary.LittleEndian.Uint64(preamble[16:]))
+	if footerOffset == 0 {
+		return ErrFrameStoreIncomplete
+	}
+
+	info, err := this.file.Stat()
+	if err != nil {
+		return err
+	}
+	if footerOffset+4 > info.Size() {
+		return ErrFrameStoreTruncated
+	}
+
+	footer := io.NewSectionReader(this.file, footerOffset, info.Size()-footerOffset)
+	var headerLength uint32
+	if err := binary.Read(footer, binary.LittleEndian, &headerLength); err != nil {
+		return fmt.Errorf("Cannot read frame store header: %v", err)
+	}
+	if int64(headerLength) > footer.Size()-4 {
+		return ErrFrameStoreTruncated
+	}
+	headerBytes := make([]byte, headerLength)
+	if _, err := io.ReadFull(footer, headerBytes); err != nil {
+		return fmt.Errorf("Cannot read frame store header: %v", err)
+	}
+	if err := json.Unmarshal(headerBytes, &this.header); err != nil {
+		return &FrameStoreMalformedError{"header: " + err.Error()}
+	}
+
+	if footer.Size() != 4+int64(headerLength)+int64(this.header.FrameCount)*frameIndexEntrySize {
+		return ErrFrameStoreTruncated
+	}
+	this.index = make([]frameIndexEntry, this.header.FrameCount)
+	if err := binary.Read(footer, binary.LittleEndian, this.index); err != nil {
+		return fmt.Errorf("Cannot read frame store index: %v", err)
+	}
+	for _, entry := range this.index {
+		if int64(entry.Offset)+int64(entry.Length) > footerOffset {
+			return &FrameStoreMalformedError{"index points past the payloads"}
+		}
+	}
+	this.end = footerOffset
+	return nil
+}
+
+func (this *FrameStore) Header() FrameStoreHeader {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.header
+}
+
+func (this *FrameStore) FrameCount() int {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return len(this.index)
+}
+
+func (this *FrameStore) Append(frame StoredFrame) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if !this.writable {
+		return ErrFrameStoreReadOnly
+	}
+	if _, err := this.file.WriteAt(frame.Payload, this.end); err != nil {
+		return err
+	}
+	entry := frameIndexEntry{
+		Offset:   uint64(this.end),
+		Length:   uint32(len(frame.Payload)),
+		Checksum: crc32.ChecksumIEEE(frame.Payload),
+		Time:     int64(frame.Timestamp / time.Microsecond),
+		Codec:    frame.Codec,
+	}
+	if !frame.Keyframe {
+		entry.Flags |= frameFlagDelta
+	}
+	this.index = append(this.index, entry)
+	this.end += int64(len(frame.Payload))
+	return nil
+}
+
+// ReadFrame reads frame i from disk, and verifies its payload.
+func (this *FrameStore) ReadFrame(i int) (StoredFrame, error) {
+	this.mutex.RLock()
+	if i < 0 || i >= len(this.index) {
+		this.mutex.RUnlock()
+		return StoredFrame{}, ErrFrameOutOfRange
+	}
+	entry := this.index[i]
+	this.mutex.RUnlock()
+
+	payload := make([]byte, entry.Length)
+	if _, err := this.file.ReadAt(payload, int64(entry.Offset)); err != nil {
+		if err == io.EOF {
+			return StoredFrame{}, ErrFrameStoreTruncated
+		}
+		return StoredFrame{}, err
+	}
+	if crc32.ChecksumIEEE(payload) != entry.Checksum {
+		return StoredFrame{}, ErrFrameChecksum
+	}
+	return StoredFrame{payload, time.Duration(entry.Time) * time.Microsecond, entry.Codec, entry.Flags&frameFlagDelta == 0}, nil
+}
+
+// Timestamp returns when frame i is presented, without reading the frame.
+func (this *FrameStore) Timestamp(i int) (time.Duration, error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	if i < 0 || i >= len(this.index) {
+		return 0, ErrFrameOutOfRange
+	}
+	return time.Duration(this.index[i].Time) * time.Microsecond, nil
+}
+
+// Finish writes the header and index, and moves the store to its final path.
+func (this *FrameStore) Finish() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if !this.writable {
+		return ErrFrameStoreReadOnly
+	}
+	this.header.FrameCount = len(this.index)
+	headerBytes, err := json.Marshal(this.header)
+	if err != nil {
+		return err
+	}
+
+	var footer bytes.Buffer
+	binary.Write(&footer, binary.LittleEndian, uint32(len(headerBytes)))
+	footer.Write(headerBytes)
+	binary.Write(&footer, binary.LittleEndian, this.index)
+	if _, err := this.file.WriteAt(footer.Bytes(), this.end); err != nil {
+		return err
+	}
+
+	var footerOffset [8]byte
+	binary.LittleEndian.PutUint64(footerOffset[:], uint64(this.end))
+	if _, err := this.file.WriteAt(footerOffset[:], 16); err != nil {
+		return err
+	}
+	if err := this.file.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(this.path+".tmp", this.path); err != nil {
+		return err
+	}
+	this.writable = false
+	return nil
+}
+
+// Abort discards a store that has not been finished. Frames already read
+// from it stay readable until it is closed, where its file is removed if the
+// platform would not remove an open file.
+func (this *FrameStore) Abort() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.writable {
+		os.Remove(this.path + ".tmp")
+		this.writable = false
+		this.aborted = true
+	}
+}
+
+// quarantineFile moves a corrupt store out of the way, keeping it for
+// inspection, and returns where it was moved to.
+func quarantineFile(path string) (string, error) {
+	quarantinePath := fmt.Sprintf("%s.%d.corrupt", path, time.Now().Unix())
+	return quarantinePath, os.Rename(path, quarantinePath)
+}
+
+func (this *FrameStore) Close() error {
+	err := this.file.Close()
+	if this.aborted {
+		os.Remove(this.path + ".tmp")
+	}
+	return err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempFrameStorePath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "framestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "movie.cache")
+}
+
+func TestFrameStoreRoundTrip(t *testing.T) {
+	path := tempFrameStorePath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	store, err := CreateFrameStore(path, FrameStoreHeader{SourceHash: "abc", Settings: "htmldiv.120.default", FrameRate: 25})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frameTime := func(i int) time.Duration { return time.Duration(i) * 40 * time.Millisecond }
+	for i := 0; i < 10; i++ {
+		if err := store.Append(StoredFrame{[]byte(fmt.Sprint("frame ", i)), frameTime(i), byte(i % 2), i%3 == 0}); err != nil {
+			t.Fatal(err)
+		}
+		// frames are readable while the store is being written
+		if frame, err := store.ReadFrame(i); err != nil || string(frame.Payload) != fmt.Sprint("frame ", i) || frame.Timestamp != frameTime(i) {
+			t.Fatal("Unexpected frame:", i, frame, err)
+		}
+	}
+	if _, err := OpenFrameStore(path); !os.IsNotExist(err) {
+		t.Error("Unfinished store should not be visible:", err)
+	}
+	if err := store.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = OpenFrameStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	header := store.Header()
+	if header.FrameCount != 10 || header.FrameRate != 25 || header.SourceHash != "abc" {
+		t.Error("Unexpected header:", header)
+	}
+	for _, i := range []int{7, 0, 9} {
+		if frame, err := store.ReadFrame(i); err != nil || string(frame.Payload) != fmt.Sprint("frame ", i) || frame.Timestamp != frameTime(i) || frame.Codec != byte(i%2) || frame.Keyframe != (i%3 == 0) {
+			t.Error("Unexpected frame:", i, frame, err)
+		}
+	}
+	if timestamp, err := store.Timestamp(3); err != nil || timestamp != frameTime(3) {
+		t.Error("Unexpected timestamp:", timestamp, err)
+	}
+	if _, err := store.ReadFrame(10); err != ErrFrameOutOfRange {
+		t.Error("Expected out of range, got:", err)
+	}
+	if err := store.Append(StoredFrame{Payload: []byte("more")}); err != ErrFrameStoreReadOnly {
+		t.Error("Expected read only, got:", err)
+	}
+}
+
+func TestFrameStoreRejectsOtherFiles(t *testing.T) {
+	path := tempFrameStorePath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	ioutil.WriteFile(path, []byte("gob encoded data"), 0666)
+	if _, err := OpenFrameStore(path); err != ErrFrameStoreFormat {
+		t.Error("Expected format error, got:", err)
+	}
+
+	content := make([]byte, frameStorePreambleSize)
+	copy(content, frameStoreMagic[:])
+	content[8] = FrameStoreVersion + 1
+	ioutil.WriteFile(path, content, 0666)
+	if _, err := OpenFrameStore(path); err != ErrFrameStoreVersion {
+		t.Error("Expected version error, got:", err)
+	}
+
+	content[8] = FrameStoreVersion
+	ioutil.WriteFile(path, content, 0666)
+	if _, err := OpenFrameStore(path); err != ErrFrameStoreIncomplete {
+		t.Error("Expected incomplete error, got:", err)
+	}
+}
+
+func TestFrameStoreDetectsCorruption(t *testing.T) {
+	path := tempFrameStorePath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	store, err := CreateFrameStore(path, FrameStoreHeader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Append(StoredFrame{Payload: []byte("first frame")})
+	store.Append(StoredFrame{Payload: []byte("second frame")})
+	if err := store.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	content, _ := ioutil.ReadFile(path)
+	content[frameStorePreambleSize+len("first frame")] ^= 0xff
+	ioutil.WriteFile(path, content, 0666)
+	store, err = OpenFrameStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ReadFrame(0); err != nil {
+		t.Error("Intact frame should be readable:", err)
+	}
+	if _, err := store.ReadFrame(1); err != ErrFrameChecksum {
+		t.Error("Expected checksum error, got:", err)
+	}
+	store.Close()
+
+	ioutil.WriteFile(path, content[:len(content)-1], 0666)
+	if _, err := OpenFrameStore(path); err != ErrFrameStoreTruncated {
+		t.Error("Expected truncated error, got:", err)
+	}
+}
+
+func TestFrameStoreCorruptionIsTold(t *testing.T) {
+	path := tempFrameStorePath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	store, err := CreateFrameStore(path, FrameStoreHeader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Append(StoredFrame{Payload: []byte("frame")})
+	if err := store.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	content, _ := ioutil.ReadFile(path)
+	footerOffset := binary.LittleEndian.Uint64(content[16:])
+	content[footerOffset+4] = 'x'
+	ioutil.WriteFile(path, content, 0666)
+	if _, err := OpenFrameStore(path); !IsFrameStoreCorrupt(err) {
+		t.Error("Expected corrupt header, got:", err)
+	}
+
+	// a store that cannot be read now is not corrupt
+	for _, err := range []error{ErrFrameStoreFormat, ErrFrameStoreVersion, os.ErrPermission, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}} {
+		if IsFrameStoreCorrupt(err) {
+			t.Error("Not a corruption:", err)
+		}
+	}
+	for _, err := range []error{ErrFrameStoreIncomplete, ErrFrameStoreTruncated, ErrFrameChecksum} {
+		if !IsFrameStoreCorrupt(err) {
+			t.Error("Expected a corruption:", err)
+		}
+	}
+}
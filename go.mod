@@ -0,0 +1,11 @@
+module github.com/jiaz/go-ascii-server
+
+go 1.22
+
+// github.com/jiaz/gmf has no tagged release, it is resolved to its latest
+// commit by `go get github.com/jiaz/gmf@latest`, as the CI workflow does.
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/pierrec/lz4 v2.6.1+incompatible
+	golang.org/x/net v0.24.0
+)
@@ -1,21 +1,215 @@
 package main
 
-import "github.com/jiaz/gmf"
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/jiaz/gmf"
+)
+
+// AV_NOPTS_VALUE, frames without a timestamp carry it
+const noPts = -1 << 63
+
+// imageBufferCount bounds how many decoded images exist at once. The decoder
+// waits for one to be released before it decodes the next.
+const imageBufferCount = 4
 
 // RGB packed image repr
 type ImageFrame struct {
-	Data []byte
+	Data      []byte        // owned by the frame until Release
+	Pts       int64         // presentation timestamp, in units of the movie's time base
+	Timestamp time.Duration // Pts as a duration
+	pool      *imagePool
+}
+
+// Release hands the buffer of the frame back to the decoder. Data must not
+// be used afterwards.
+func (this *ImageFrame) Release() {
+	if this.pool != nil && this.Data != nil {
+		this.pool.put(this.Data)
+	}
+	this.Data = nil
+}
+
+// imagePool recycles a fixed number of image buffers.
+type imagePool struct {
+	free chan []byte
+}
+
+func newImagePool(size int, count int) *imagePool {
+	pool := &imagePool{free: make(chan []byte, count)}
+	for i := 0; i < count; i++ {
+		pool.free <- make([]byte, size)
+	}
+	return pool
+}
+
+// get waits until a buffer is free.
+func (this *imagePool) get() []byte {
+	return <-this.free
+}
+
+func (this *imagePool) put(buf []byte) {
+	this.free <- buf
+}
+
+// copyImage copies rows of rowSize bytes from src, where they are stride
+// bytes apart, to be packed in dst.
+func copyImage(dst []byte, src []byte, rowSize int, stride int, rows int) {
+	for y := 0; y < rows; y++ {
+		copy(dst[y*rowSize:(y+1)*rowSize], src[y*stride:y*stride+rowSize])
+	}
+}
+
+// scaleFilters maps the names of the swscale filters images can be scaled
+// with to their flags.
+var scaleFilters = map[string]int{
+	"point":    gmf.SWS_POINT,
+	"bilinear": gmf.SWS_BILINEAR,
+	"area":     gmf.SWS_AREA,
+	"lanczos":  gmf.SWS_LANCZOS,
+}
+
+// scaleFilter returns the swscale flags of a filter.
+func scaleFilter(name string) (int, error) {
+	if flags, ok := scaleFilters[name]; ok {
+		return flags, nil
+	}
+	return 0, fmt.Errorf("Unknown scale filter %q", name)
+}
+
+// ScaleFilterNames lists the filters images can be scaled with, sorted.
+func ScaleFilterNames() []string {
+	names := make([]string, 0, len(scaleFilters))
+	for name := range scaleFilters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ImageScale tells what size loadMovie scales images to. Images are never
+// scaled up.
+type ImageScale struct {
+	Width  int    // 0 keeps the source size, the aspect is always kept
+	Filter string // point, bilinear, area, lanczos
+}
+
+// size returns the image size for a source of srcWidth x srcHeight.
+func (this ImageScale) size(srcWidth int, srcHeight int) (int, int) {
+	if this.Width <= 0 || this.Width >= srcWidth {
+		return srcWidth, srcHeight
+	}
+	height := (this.Width*srcHeight + srcWidth/2) / srcWidth
+	if height < 1 {
+		height = 1
+	}
+	return this.Width, height
 }
 
 type Movie struct {
-	Width       int
+	Width       int // of the scaled images
 	Height      int
 	Bpp         int
 	FrameCount  int
-	ImageStream <-chan *ImageFrame
+	FrameRate   float64 // average frames per second, 0 if unknown
+	TimeBase    gmf.AVR
+	ImageStream <-chan *ImageFrame // every frame must be released
+
+	// set before ImageStream is closed
+	err            error
+	corruptPackets int
+}
+
+// DecodeError tells that a movie could not be decoded, as opposed to a
+// failure of the server.
+type DecodeError struct {
+	Path string
+	Err  error
+}
+
+func (this *DecodeError) Error() string {
+	return "Cannot decode " + this.Path + ": " + this.Err.Error()
+}
+
+// Err returns why decoding stopped early, or nil if every frame was decoded.
+// It is only valid once ImageStream is closed.
+func (this *Movie) Err() error {
+	return this.err
+}
+
+// CorruptPackets returns how many packets could not be decoded and were
+// skipped. It is only valid once ImageStream is closed.
+func (this *Movie) CorruptPackets() int {
+	return this.corruptPackets
 }
 
-func loadMovie(srcFileName string) (*Movie, error) {
+// probeMovie checks whether srcFileName can be opened and has a video stream,
+// and returns the frame count and frame rate reported by the container.
+func probeMovie(srcFileName string) (int, float64, error) {
+	inputCtx, err := gmf.NewInputCtx(srcFileName)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer inputCtx.CloseInputAndRelease()
+
+	srcStream, err := inputCtx.GetBestStream(gmf.AVMEDIA_TYPE_VIDEO)
+	if err != nil {
+		return 0, 0, err
+	}
+	return srcStream.NbFrames(), streamFrameRate(srcStream), nil
+}
+
+// streamFrameRate prefers the average frame rate, which is what variable
+// frame rate clips average out to, over the container's base rate.
+func streamFrameRate(stream *gmf.Stream) float64 {
+	for _, rate := range []gmf.AVR{stream.GetAvgFrameRate().AVR(), stream.GetRFrameRate().AVR()} {
+		if rate.Num > 0 && rate.Den > 0 {
+			return float64(rate.Num) / float64(rate.Den)
+		}
+	}
+	return 0
+}
+
+// ptsToDuration converts a timestamp in units of timeBase.
+func ptsToDuration(pts int64, timeBase gmf.AVR) time.Duration {
+	if timeBase.Den == 0 {
+		return 0
+	}
+	// split to avoid overflowing int64 nanoseconds for large timestamps
+	num, den := int64(timeBase.Num), int64(timeBase.Den)
+	seconds := pts * num / den
+	rest := pts*num - seconds*den
+	return time.Duration(seconds)*time.Second + time.Duration(rest)*time.Second/time.Duration(den)
+}
+
+// newScaler configures swscale to convert the frames decoded by srcCtx to
+// width x height in pixFmt. swscale only reads the size and pixel format of
+// the output context, so it is described by a context that is never opened
+// rather than by an encoder.
+func newScaler(srcCtx *gmf.CodecCtx, width int, height int, pixFmt int32, flags int) (*gmf.SwsCtx, error) {
+	dstCtx := gmf.NewCodecCtx(srcCtx.Codec())
+	if dstCtx == nil {
+		return nil, errors.New("Cannot allocate scaler output context")
+	}
+	defer gmf.Release(dstCtx)
+	dstCtx.SetPixFmt(pixFmt).SetWidth(width).SetHeight(height)
+
+	swsCtx := gmf.NewSwsCtx(srcCtx, dstCtx, flags)
+	if swsCtx == nil {
+		return nil, errors.New("Cannot create scaler")
+	}
+	return swsCtx, nil
+}
+
+func loadMovie(srcFileName string, scale ImageScale) (*Movie, error) {
+	filter, err := scaleFilter(scale.Filter)
+	if err != nil {
+		return nil, err
+	}
 	inputCtx, err := gmf.NewInputCtx(srcFileName)
 	if err != nil {
 		return nil, err
@@ -23,11 +217,12 @@ func loadMovie(srcFileName string) (*Movie, error) {
 
 	srcStream, err := inputCtx.GetBestStream(gmf.AVMEDIA_TYPE_VIDEO)
 	if err != nil {
+		inputCtx.CloseInputAndRelease()
 		return nil, err
 	}
 
 	srcCtx := srcStream.CodecCtx()
-	w, h := srcCtx.Width(), srcCtx.Height()
+	w, h := scale.size(srcCtx.Width(), srcCtx.Height())
 
 	output := make(chan *ImageFrame)
 
@@ -36,58 +231,93 @@ func loadMovie(srcFileName string) (*Movie, error) {
 	movie.Height = h
 	movie.Bpp = 24
 	movie.FrameCount = srcStream.NbFrames()
+	movie.FrameRate = streamFrameRate(srcStream)
+	movie.TimeBase = srcStream.TimeBase().AVR()
 	movie.ImageStream = output
 
 	go func() {
 		defer inputCtx.CloseInputAndRelease()
 		defer close(output)
 
-		dstCodec, err := gmf.FindEncoder(gmf.AV_CODEC_ID_JPEG2000)
-		if err != nil {
-			fatal(err)
+		fail := func(err error) {
+			movie.err = &DecodeError{srcFileName, err}
 		}
-		dstCtx := gmf.NewCodecCtx(dstCodec)
-		defer gmf.Release(dstCtx)
 
-		dstCtx.SetPixFmt(gmf.AV_PIX_FMT_RGB24).SetWidth(w).SetHeight(h)
-		if dstCodec.IsExperimental() {
-			dstCtx.SetStrictCompliance(-2)
-		}
-		if err := dstCtx.Open(nil); err != nil {
-			fatal(err)
+		swsCtx, err := newScaler(srcCtx, w, h, gmf.AV_PIX_FMT_RGB24, filter)
+		if err != nil {
+			fail(err)
+			return
 		}
-
-		swsCtx := gmf.NewSwsCtx(srcCtx, dstCtx, gmf.SWS_POINT)
 		defer gmf.Release(swsCtx)
 
 		dstFrame := gmf.NewFrame().SetWidth(w).SetHeight(h).SetFormat(gmf.AV_PIX_FMT_RGB24)
 		defer gmf.Release(dstFrame)
 
 		if err := dstFrame.ImgAlloc(); err != nil {
-			fatal(err)
+			fail(err)
+			return
 		}
 
-		for packet := range inputCtx.GetNewPackets() {
-			defer gmf.Release(packet)
+		// frames that lack a timestamp are placed one frame after the previous
+		var frameDuration int64
+		if movie.FrameRate > 0 && movie.TimeBase.Num > 0 {
+			frameDuration = int64(float64(movie.TimeBase.Den) / float64(movie.TimeBase.Num) / movie.FrameRate)
+		}
+		lastPts := int64(noPts)
+
+		// the scaler writes every image to dstFrame, consumers get copies
+		rowSize := w * movie.Bpp / 8
+		pool := newImagePool(rowSize*h, imageBufferCount)
 
+		emit := func(frame *gmf.Frame) {
+			pts := frame.BestEffortTimestamp()
+			if pts == noPts {
+				pts = frame.Pts()
+			}
+			if pts == noPts {
+				if lastPts == noPts {
+					pts = 0
+				} else {
+					pts = lastPts + frameDuration
+				}
+			}
+			lastPts = pts
+
+			swsCtx.Scale(frame, dstFrame)
+			data := pool.get()
+			copyImage(data, dstFrame.DataUnsafe(0), rowSize, dstFrame.LineSize(0), h)
+			output <- &ImageFrame{data, pts, ptsToDuration(pts, movie.TimeBase), pool}
+		}
+
+		for packet := range inputCtx.GetNewPackets() {
 			if packet.StreamIndex() != srcStream.Index() {
+				gmf.Release(packet)
 				continue
 			}
 
-			inStream, err := inputCtx.GetStream(packet.StreamIndex())
+			// a video packet holds at most one frame
+			frame, ready, _, err := packet.Decode(srcCtx)
 			if err != nil {
-				fatal(err)
+				movie.corruptPackets++
+				log.Println("Skipping corrupt packet:", srcFileName, err)
 			}
-
-			inCtx := inStream.CodecCtx()
-
-			for frame := range packet.Frames(inCtx) {
-				swsCtx.Scale(frame, dstFrame)
-				p := dstFrame.DataUnsafe(0)
-				output <- &ImageFrame{p}
+			if err == nil && ready {
+				emit(frame)
 			}
+			gmf.Release(packet)
 		}
 
+		// decoders that reorder frames hold the last ones back until they
+		// are sent an empty packet
+		flush := gmf.NewPacket()
+		defer gmf.Release(flush)
+		for {
+			frame, ready, _, err := flush.Decode(srcCtx)
+			if err != nil || !ready {
+				break
+			}
+			emit(frame)
+		}
 	}()
 
 	return movie, nil
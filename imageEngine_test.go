@@ -1,16 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"testing"
+	"time"
+
+	"github.com/jiaz/gmf"
 )
 
 func TestImageEngineDecoding(t *testing.T) {
-	movie, err := loadMovie("resources/demo.m4v")
+	movie, err := loadMovie("resources/demo.m4v", ImageScale{Filter: "point"})
 	if err != nil {
 		t.Fatal("Cannot load movie")
 	}
-	converter, err := NewAsciiConverter(movie, 60)
+	converter, err := NewAsciiConverter(movie, 60, DefaultRenderProfile)
 	if err != nil {
 		t.Fatal("Cannot create converter")
 	}
@@ -22,6 +26,7 @@ func TestImageEngineDecoding(t *testing.T) {
 		fmt.Println("w:", movie.Width, "h:", movie.Height)
 		//v := string(processSimple(movie.Width, movie.Height, img))
 		v, _ := converter.ConvertToAnsi(img)
+		img.Release()
 		fmt.Println(v)
 		j += 1
 	}
@@ -30,3 +35,169 @@ func TestImageEngineDecoding(t *testing.T) {
 	// 	t.Fatalf("Expected frame count: %d, but get: %d", movie.FrameCount, j)
 	// }
 }
+
+func TestImageEngineFramesNotAliased(t *testing.T) {
+	movie, err := loadMovie("resources/demo.m4v", ImageScale{Filter: "point"})
+	if err != nil {
+		t.Fatal("Cannot load movie")
+	}
+	defer func() {
+		for img := range movie.ImageStream {
+			img.Release()
+		}
+	}()
+
+	var held []*ImageFrame
+	var copies [][]byte
+	for img := range movie.ImageStream {
+		held = append(held, img)
+		copies = append(copies, append([]byte(nil), img.Data...))
+		if len(held) == imageBufferCount {
+			break
+		}
+	}
+	for i, img := range held {
+		if !bytes.Equal(img.Data, copies[i]) {
+			t.Error("Frame overwritten while held:", i)
+		}
+		if i > 0 && &img.Data[0] == &held[i-1].Data[0] {
+			t.Error("Frames share a buffer:", i)
+		}
+		img.Release()
+	}
+}
+
+func TestImagePoolNotAliased(t *testing.T) {
+	const size = 16
+	pool := newImagePool(size, 2)
+	// the decoder scales every image into the same buffer
+	scratch := make([]byte, 2*size)
+	decode := func(value byte) *ImageFrame {
+		for i := range scratch {
+			scratch[i] = value
+		}
+		data := pool.get()
+		copyImage(data, scratch, 4, 8, 4)
+		return &ImageFrame{Data: data, pool: pool}
+	}
+
+	first, second := decode(1), decode(2)
+	if !bytes.Equal(first.Data, bytes.Repeat([]byte{1}, size)) || !bytes.Equal(second.Data, bytes.Repeat([]byte{2}, size)) {
+		t.Error("Frames overwritten by later images:", first.Data, second.Data)
+	}
+
+	// every buffer is held, the decoder waits for one to be released
+	decoded := make(chan *ImageFrame)
+	go func() { decoded <- decode(3) }()
+	select {
+	case <-decoded:
+		t.Fatal("Decoded past the pool size")
+	case <-time.After(50 * time.Millisecond):
+	}
+	first.Release()
+	third := <-decoded
+	if third.Data[0] != 3 || second.Data[0] != 2 {
+		t.Error("Unexpected frame content:", third.Data, second.Data)
+	}
+	if first.Data != nil {
+		t.Error("Released frame still has data")
+	}
+	// releasing twice must not hand the buffer out twice
+	first.Release()
+	second.Release()
+	third.Release()
+	if len(pool.free) != 2 {
+		t.Error("Unexpected free buffers:", len(pool.free))
+	}
+}
+
+func TestImageScaleSize(t *testing.T) {
+	for _, test := range []struct {
+		scale         ImageScale
+		srcW, srcH    int
+		width, height int
+	}{
+		{ImageScale{}, 1920, 1080, 1920, 1080},
+		{ImageScale{Width: 480}, 1920, 1080, 480, 270},
+		{ImageScale{Width: 481}, 1920, 1080, 481, 271},
+		// never scaled up
+		{ImageScale{Width: 480}, 320, 240, 320, 240},
+		{ImageScale{Width: 2}, 1000, 10, 2, 1},
+	} {
+		width, height := test.scale.size(test.srcW, test.srcH)
+		if width != test.width || height != test.height {
+			t.Errorf("%+v of %dx%d: expected %dx%d, got %dx%d", test.scale, test.srcW, test.srcH, test.width, test.height, width, height)
+		}
+	}
+}
+
+func TestScaleFilter(t *testing.T) {
+	for _, name := range ScaleFilterNames() {
+		if _, err := scaleFilter(name); err != nil {
+			t.Error(err)
+		}
+	}
+	if flags, err := scaleFilter("point"); err != nil || flags != gmf.SWS_POINT {
+		t.Error("Unexpected point filter:", flags, err)
+	}
+	for _, name := range []string{"", "sharpen"} {
+		if _, err := scaleFilter(name); err == nil {
+			t.Errorf("Expected error for filter %q", name)
+		}
+	}
+}
+
+// benchmarkConvert decodes and dithers b.N frames at 120 columns, starting
+// over when the movie ends.
+func benchmarkConvert(b *testing.B, scale ImageScale) {
+	var movie *Movie
+	var converter *AsciiConverter
+	done := func() {
+		if movie != nil {
+			for img := range movie.ImageStream {
+				img.Release()
+			}
+			converter.Free()
+		}
+	}
+	defer done()
+
+	for i := 0; i < b.N; i++ {
+		img, more := (*ImageFrame)(nil), false
+		if movie != nil {
+			img, more = <-movie.ImageStream
+		}
+		if !more {
+			b.StopTimer()
+			done()
+			var err error
+			if movie, err = loadMovie("resources/demo.m4v", scale); err != nil {
+				b.Fatal("Cannot load movie:", err)
+			}
+			if converter, err = NewAsciiConverter(movie, 120, DefaultRenderProfile); err != nil {
+				b.Fatal("Cannot create converter:", err)
+			}
+			b.StartTimer()
+			if img, more = <-movie.ImageStream; !more {
+				b.Fatal("Movie has no frames")
+			}
+		}
+		if _, err := converter.Convert(CACA_EXPORT_FMT_HTMLCLASS, img); err != nil {
+			b.Fatal(err)
+		}
+		img.Release()
+	}
+}
+
+// the path before images were scaled down: full size, point sampled
+func BenchmarkConvertFullSize(b *testing.B) {
+	benchmarkConvert(b, ImageScale{Filter: "point"})
+}
+
+func BenchmarkConvertScaled(b *testing.B) {
+	for _, name := range ScaleFilterNames() {
+		b.Run(name, func(b *testing.B) {
+			benchmarkConvert(b, imageScale(120, &RenderProfile{Scaler: name}))
+		})
+	}
+}
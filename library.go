@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// files with these extensions are produced by the server itself
+var ignoredExts = map[string]bool{
+	".cache":   true,
+	".lock":    true,
+	".tmp":     true,
+	".corrupt": true,
+	".stale":   true,
+}
+
+type MovieEntry struct {
+	Id         string
+	Path       string
+	FrameCount int     // as reported by the container
+	FrameRate  float64 // as reported by the container, 0 if unknown
+
+	mutex      sync.Mutex
+	renditions map[RenditionKey]*Rendition
+	audio      map[string]*Rendition // by codec
+	err        error                 // why the movie cannot be played, nil if it can
+}
+
+// Fail marks the movie as unplayable.
+func (this *MovieEntry) Fail(err error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.err = err
+}
+
+func (this *MovieEntry) Err() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.err
+}
+
+// Rendition returns the frames of the movie rendered as described by key,
+// queueing a transcoding job the first time a key is asked for.
+func (this *MovieEntry) Rendition(key RenditionKey) *Rendition {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	rendition, ok := this.renditions[key]
+	if !ok {
+		rendition = NewRendition(this.FrameCount, this.FrameRate)
+		rendition.rebuild = func() {
+			transcodeQueue.Submit(&TranscodeJob{this, key, rendition, true, false})
+		}
+		this.renditions[key] = rendition
+		transcodeQueue.Submit(&TranscodeJob{this, key, rendition, false, false})
+	}
+	return rendition
+}
+
+// Audio returns the audio track of the movie compressed with codec, queueing
+// its extraction the first time. Its chunks are read like frames, and fail
+// with ErrNoAudio if the movie has no sound.
+func (this *MovieEntry) Audio(codec string) *Rendition {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	rendition, ok := this.audio[codec]
+	if !ok {
+		key := RenditionKey{Codec: codec}
+		// estimated from the length of the video until extracted, rounded up
+		// so no chunk of a track as long as the video is out of range
+		chunks := 0
+		if this.FrameRate > 0 {
+			chunks = int(math.Ceil(float64(this.FrameCount) / this.FrameRate * audioChunkRate))
+		}
+		rendition = NewRendition(chunks, audioChunkRate)
+		rendition.rebuild = func() {
+			transcodeQueue.Submit(&TranscodeJob{this, key, rendition, true, true})
+		}
+		this.audio[codec] = rendition
+		transcodeQueue.Submit(&TranscodeJob{this, key, rendition, false, true})
+	}
+	return rendition
+}
+
+// Renditions returns a snapshot of the renditions clients have asked for.
+func (this *MovieEntry) Renditions() map[RenditionKey]*Rendition {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	renditions := make(map[RenditionKey]*Rendition, len(this.renditions))
+	for key, rendition := range this.renditions {
+		renditions[key] = rendition
+	}
+	return renditions
+}
+
+// PeekRendition returns the rendition for key, or nil if no client has asked
+// for it yet.
+func (this *MovieEntry) PeekRendition(key RenditionKey) *Rendition {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.renditions[key]
+}
+
+// MovieLibrary is safe for concurrent use, movies are added while clients
+// are served.
+type MovieLibrary struct {
+	mutex  sync.Mutex
+	movies map[string]*MovieEntry
+	ids    []string
+}
+
+func NewMovieLibrary() *MovieLibrary {
+	return &MovieLibrary{movies: make(map[string]*MovieEntry)}
+}
+
+// Id of a movie is its file name without extension, unless that clashes with
+// another movie, in which case the full file name is used.
+func (this *MovieLibrary) Add(path string, frameCount int, frameRate float64) *MovieEntry {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	name := filepath.Base(path)
+	id := strings.TrimSuffix(name, filepath.Ext(name))
+	if _, ok := this.movies[id]; ok || id == "" {
+		id = name
+	}
+	entry := &MovieEntry{
+		Id:         id,
+		Path:       path,
+		FrameCount: frameCount,
+		FrameRate:  frameRate,
+		renditions: make(map[RenditionKey]*Rendition),
+		audio:      make(map[string]*Rendition),
+	}
+	this.movies[id] = entry
+	this.ids = append(this.ids, id)
+	sort.Strings(this.ids)
+	return entry
+}
+
+// Get looks up a movie by id. An empty id selects the default movie.
+func (this *MovieLibrary) Get(id string) (*MovieEntry, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if id == "" {
+		if len(this.ids) == 0 {
+			return nil, errors.New("No movies available")
+		}
+		id = this.ids[0]
+	}
+	entry, ok := this.movies[id]
+	if !ok {
+		return nil, errors.New("Unknown movie: " + id)
+	}
+	return entry, nil
+}
+
+// Ids returns the sorted ids of the movies added so far.
+func (this *MovieLibrary) Ids() []string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return append([]string(nil), this.ids...)
+}
+
+// Scan adds every decodable video file directly under dir to the library.
+func (this *MovieLibrary) Scan(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || ignoredExts[filepath.Ext(f.Name())] {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		frameCount, frameRate, err := probeMovie(path)
+		if err != nil {
+			log.Println("Skipping", path, ":", err)
+			continue
+		}
+		this.Add(path, frameCount, frameRate)
+	}
+	return nil
+}
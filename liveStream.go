@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Live streaming lets a client play a movie without buffering it. After a
+// PLAY command the server sends every frame as a FRAME response when it is
+// due, on a clock derived from the frame timestamps. A frame that is late
+// because the client could not keep up is dropped when the next one is due
+// as well, so slow clients skip frames instead of falling behind.
+
+const (
+	livePollInterval   = 100 * time.Millisecond // while waiting for conversion
+	liveReportInterval = time.Second
+)
+
+type liveCommand struct {
+	Type      string // PLAY, PAUSE or SEEK
+	RequestId interface{}
+	Mode      FrameMode
+	Deltas    bool
+	Entry     *MovieEntry
+	Key       RenditionKey
+	Rendition *Rendition
+	Frame     int           // position to move to, -1 to keep it
+	Time      time.Duration // position to move to if Frame is -1, -1 to keep it
+}
+
+type LiveStream struct {
+	conn     *websocket.Conn
+	commands chan *liveCommand
+	done     chan struct{}
+
+	// owned by run
+	entry     *MovieEntry
+	key       RenditionKey
+	rendition *Rendition
+	requestId interface{} // of the PLAY command, frames are tagged with it
+	mode      FrameMode
+	deltas    bool
+	assembler *frameAssembler // passes on deltas, or completes them after a seek or drop
+	position  int             // next frame to send
+	timestamp time.Duration   // of the last frame sent
+	playing   bool
+	anchored  bool
+	anchor    time.Time // when timestamp 0 is due
+	sent      int
+	dropped   int
+}
+
+func NewLiveStream(conn *websocket.Conn) *LiveStream {
+	stream := &LiveStream{
+		conn:     conn,
+		commands: make(chan *liveCommand, 1),
+		done:     make(chan struct{}),
+	}
+	go stream.run()
+	return stream
+}
+
+func (this *LiveStream) Send(cmd *liveCommand) {
+	this.commands <- cmd
+}
+
+// Stop ends the stream and waits for the last frame to be sent.
+func (this *LiveStream) Stop() {
+	close(this.commands)
+	<-this.done
+}
+
+func (this *LiveStream) run() {
+	defer close(this.done)
+	report := time.NewTicker(liveReportInterval)
+	defer report.Stop()
+
+	for {
+		var timer *time.Timer
+		var due <-chan time.Time
+		if this.playing {
+			timer = time.NewTimer(this.step())
+			due = timer.C
+		}
+		select {
+		case cmd, more := <-this.commands:
+			if !more {
+				return
+			}
+			this.handle(cmd)
+		case <-due:
+		case <-report.C:
+			if this.playing {
+				this.sendPosition("POSITION", this.requestId)
+			}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (this *LiveStream) handle(cmd *liveCommand) {
+	if cmd.Rendition != nil && (cmd.Entry != this.entry || cmd.Key != this.key) {
+		log.Println("Live streaming, movie:", cmd.Entry.Id, "rendition:", cmd.Key)
+		// another rendition of the same movie continues at the same frame
+		if cmd.Entry != this.entry {
+			this.position, this.timestamp, this.sent, this.dropped = 0, 0, 0, 0
+		}
+		this.entry, this.key, this.rendition = cmd.Entry, cmd.Key, cmd.Rendition
+		this.assembler = newFrameAssembler(cmd.Rendition, cmd.Key.Format)
+	}
+	if this.rendition == nil {
+		sendError(this.conn, cmd.Type, cmd.RequestId, errors.New("Nothing is playing"))
+		return
+	}
+
+	if cmd.Frame >= 0 {
+		this.position = cmd.Frame
+	} else if cmd.Time >= 0 {
+		this.position = this.rendition.FrameAt(cmd.Time)
+	}
+	// the clock restarts from the next frame sent
+	this.anchored = false
+	switch cmd.Type {
+	case "PLAY":
+		this.playing = true
+		this.requestId = cmd.RequestId
+		this.mode = cmd.Mode
+		this.deltas = cmd.Deltas
+	case "PAUSE":
+		this.playing = false
+	}
+	this.sendPosition(cmd.Type, cmd.RequestId)
+}
+
+// step sends the frame at the current position if it is due, and returns
+// how long to wait before the next step.
+func (this *LiveStream) step() time.Duration {
+	timestamp, err := this.rendition.Timestamp(this.position)
+	switch err {
+	case nil:
+	case ErrFrameNotReady:
+		// conversion is behind, resume the clock once it catches up
+		this.anchored = false
+		return livePollInterval
+	case ErrFrameOutOfRange:
+		this.playing = false
+		this.sendPosition("END", this.requestId)
+		return 0
+	default:
+		this.playing = false
+		sendError(this.conn, "PLAY", this.requestId, err)
+		return 0
+	}
+
+	now := time.Now()
+	if !this.anchored {
+		this.anchor = now.Add(-timestamp)
+		this.anchored = true
+	}
+	if wait := this.anchor.Add(timestamp).Sub(now); wait > 0 {
+		return wait
+	}
+	if next, err := this.rendition.Timestamp(this.position + 1); err == nil && !now.Before(this.anchor.Add(next)) {
+		this.position++
+		this.dropped++
+		return 0
+	}
+
+	frame, generation, err := this.rendition.ReadFrame(this.position, false, nil)
+	if err == nil {
+		frame, err = this.assembler.Next(this.position, generation, frame, this.deltas)
+	}
+	if err != nil {
+		// retried on the next step
+		log.Println("Cannot read frame:", this.entry.Id, this.position, err)
+		return livePollInterval
+	}
+	sendFrame(this.conn, this.mode, "FRAME", this.requestId, this.entry, this.key, this.position, frame)
+	this.position++
+	this.timestamp = frame.Timestamp
+	this.sent++
+	return 0
+}
+
+func (this *LiveStream) sendPosition(cmdType string, requestId interface{}) {
+	total, _, done := this.rendition.Counts()
+	websocket.JSON.Send(this.conn, WSResponse{200, cmdType, map[string]interface{}{
+		"Id":         this.entry.Id,
+		"Index":      this.position,
+		"Timestamp":  int64(this.timestamp / time.Millisecond),
+		"FrameCount": total,
+		"Done":       done,
+		"Playing":    this.playing,
+		"Sent":       this.sent,
+		"Dropped":    this.dropped,
+	}, requestId})
+}
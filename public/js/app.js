@@ -17,6 +17,8 @@ var Debug = {
  *   - Dequeue: Get a new element from the head and remove it from the buffer.
  *              When there is nothing in the queue, undefined will be returned.
  *
+ *   - Peek:    Get the element at the head without removing it.
+ *
  * The buffer will also trigger `onChanged` callback when the content length is changed.
  */
 function CircularBuffer(bufferSize) {
@@ -64,6 +66,11 @@ CircularBuffer.prototype.Dequeue = function() {
     }
 };
 
+CircularBuffer.prototype.Peek = function() {
+    if (this._tailPos == this._sentinalPos) return undefined;
+    return this._buffer[this._nextPos(this._sentinalPos)];
+};
+
 CircularBuffer.prototype.Length = function() {
     if (this._tailPos >= this._sentinalPos) {
         return this._tailPos - this._sentinalPos;
@@ -72,9 +79,83 @@ CircularBuffer.prototype.Length = function() {
     }
 };
 
+/* Header of binary frame messages, all integers little endian:
+ *
+ *   version:u8 kind:u8 codec:u8 flags:u8 requestId:u32 index:u32 timestamp:u32
+ *
+ * Flag bit 0 marks a delta frame.
+ */
+var BinaryFrame = {
+    HEADER_SIZE: 16,
+    FLAG_DELTA: 1,
+    KIND_TYPES: {
+        1: "GETDATA",
+        2: "FRAME",
+        3: "GETAUDIO"
+    },
+
+    Parse: function(buffer) {
+        var view = new DataView(buffer);
+        return {
+            Type: this.KIND_TYPES[view.getUint8(1)],
+            Codec: view.getUint8(2),
+            Keyframe: (view.getUint8(3) & this.FLAG_DELTA) == 0,
+            RequestId: view.getUint32(4, true),
+            Index: view.getUint32(8, true),
+            Timestamp: view.getUint32(12, true),
+            Frame: new Uint8Array(buffer, this.HEADER_SIZE)
+        };
+    }
+};
+
+/* Decompresses frame payloads by the codec id in their header. The server
+ * stores each movie with one codec, and uses one of the codecs we list on
+ * connect when we cannot decode the movie's own.
+ */
+var FrameCodecs = {
+    NAMES: ["gzip", "deflate", "lz4", "none"], // in order of preference
+
+    Decode: function(codec, payload) {
+        switch (codec) {
+            case 0: // none
+                return new TextDecoder("utf-8").decode(payload);
+            case 1: // gzip
+                return pako.ungzip(payload, {
+                    to: 'string'
+                });
+            case 2: // deflate
+                return pako.inflateRaw(payload, {
+                    to: 'string'
+                });
+            case 3: // lz4
+                var Buffer = require("buffer").Buffer;
+                return require("lz4").decode(new Buffer(payload)).toString("utf8");
+            default:
+                throw new Error("Unsupported codec: " + codec);
+        }
+    },
+
+    DecodeBytes: function(codec, payload) {
+        switch (codec) {
+            case 0: // none
+                return payload;
+            case 1: // gzip
+                return pako.ungzip(payload);
+            case 2: // deflate
+                return pako.inflateRaw(payload);
+            case 3: // lz4
+                var Buffer = require("buffer").Buffer;
+                return new Uint8Array(require("lz4").decode(new Buffer(payload)));
+            default:
+                throw new Error("Unsupported codec: " + codec);
+        }
+    }
+};
+
 function WSManager(host) {
     this._host = host;
     this._responseHandlerRegistry = {};
+    this._binaryHandlerRegistry = {};
     this._errHandler;
     this._ws;
 }
@@ -82,6 +163,17 @@ function WSManager(host) {
 WSManager.prototype._hookupEvents = function(openCallback) {
     var self = this;
     this._ws.onmessage = function(ev) {
+        if (ev.data instanceof ArrayBuffer) {
+            var frame = BinaryFrame.Parse(ev.data);
+            var binaryHandler = self._binaryHandlerRegistry[frame.Type];
+            if (binaryHandler === undefined) {
+                Debug.Log("No handler defined for binary frame type: " + frame.Type);
+            } else {
+                binaryHandler(frame);
+            }
+            return;
+        }
+
         var responseData = JSON.parse(ev.data)
         if (Debug.InDebugMode) {
         	Debug.Log("Received response, code:" + responseData.ErrorCode + ", type: " + responseData.Type);
@@ -108,39 +200,222 @@ WSManager.prototype.RegisterHandler = function(eventType, handler) {
     this._responseHandlerRegistry[eventType] = handler;
 }
 
+WSManager.prototype.RegisterBinaryHandler = function(eventType, handler) {
+    this._binaryHandlerRegistry[eventType] = handler;
+}
+
 WSManager.prototype.SetErrorHandler = function(handler) {
     this._errHandler = handler;
 }
 
-WSManager.prototype.Connect = function(callback) {
+WSManager.prototype.Connect = function(query, callback) {
     Debug.Log("Start websocket connection...");
-    this._ws = new WebSocket("ws://" + this._host + "/play");
+    this._ws = new WebSocket("ws://" + this._host + "/play?" + $.param(query));
+    this._ws.binaryType = "arraybuffer";
     this._hookupEvents(callback);
 }
 
-WSManager.prototype.SendCommand = function(cmdType, args) {
+WSManager.prototype.SendCommand = function(cmdType, args, requestId) {
     var cmd = {
         type: cmdType
     };
     if (args !== undefined) {
         cmd.args = args;
     }
+    if (requestId !== undefined) {
+        cmd.requestId = requestId;
+    }
     this._ws.send(JSON.stringify(cmd));
 }
 
+/* Plays the audio track of a movie through the Web Audio API. Chunks of 16
+ * bit PCM are fetched ahead, and scheduled against the clock the video
+ * player presents frames with.
+ */
+function AudioPlayer(wsManager) {
+    this.BLOCK_SIZE = 40; // chunks per request, 10 seconds
+    this.LOOKAHEAD = 1000; // ms of audio scheduled ahead of the clock
+    this.INFO_RETRY = 1000; // ms between polls until extraction has started
+
+    this._wsManager = wsManager;
+    var AudioContext = window.AudioContext || window.webkitAudioContext;
+    this._ctx = AudioContext ? new AudioContext() : undefined;
+
+    this._movieId = undefined;
+    this._sampleRate = 0;
+    this._channels = 0;
+    this._chunkCount = 0; // known to exist, all of them once done
+    this._done = false; // whether the track is fully extracted
+    this._chunks = []; // {timestamp, buffer} by index
+    this._requestedEnd = 0;
+    this._received = 0;
+    this._sources = []; // scheduled, not yet ended
+    this._next = undefined; // index of the next chunk to schedule
+
+    this._lastRequestId = 0;
+    this._movieRequestId = 1;
+}
+
+AudioPlayer.prototype.Init = function() {
+    var self = this;
+    if (this._ctx === undefined) {
+        Debug.Log("No Web Audio support, playing without sound");
+        return;
+    }
+
+    this._wsManager.RegisterHandler("GETAUDIOINFO", function(data) {
+        if (data.Id !== self._movieId || !data.HasAudio) return;
+        if (data.SampleRate == 0) {
+            self._queryInfo(self.INFO_RETRY);
+            return;
+        }
+        self._sampleRate = data.SampleRate;
+        self._channels = data.Channels;
+        // the total is only an estimate until the track is extracted
+        self._chunkCount = data.Done ? data.ChunkCount : data.ConvertedChunks;
+        self._done = data.Done;
+        Debug.Log("Got audio track, chunks: " + self._chunkCount + ", done: " + data.Done + ", rate: " + data.SampleRate + ", channels: " + data.Channels);
+        // a block in flight loads the next one once received
+        if (self._received == self._requestedEnd) {
+            self._loadNextBlock();
+        }
+    });
+
+    this._wsManager.RegisterBinaryHandler("GETAUDIO", function(data) {
+        if (data.RequestId < self._movieRequestId) return;
+        self._addChunk(data.Index, data.Timestamp, FrameCodecs.DecodeBytes(data.Codec, data.Frame));
+    });
+};
+
+AudioPlayer.prototype.Load = function(movieId) {
+    if (this._ctx === undefined) return;
+    this.Stop();
+    this._movieId = movieId;
+    this._sampleRate = 0;
+    this._chunkCount = 0;
+    this._done = false;
+    this._chunks = [];
+    this._requestedEnd = 0;
+    this._received = 0;
+    this._movieRequestId = this._lastRequestId + 1;
+    this._queryInfo(0);
+};
+
+AudioPlayer.prototype._queryInfo = function(delay) {
+    var self = this;
+    var movieId = this._movieId;
+    window.setTimeout(function() {
+        if (movieId !== self._movieId) return;
+        self._wsManager.SendCommand("GETAUDIOINFO", {
+            id: movieId
+        });
+    }, delay);
+};
+
+// Requests the next block of chunks known to exist. While the track is
+// being extracted the server is asked again how far it has got.
+AudioPlayer.prototype._loadNextBlock = function() {
+    var from = this._requestedEnd;
+    if (from >= this._chunkCount) {
+        if (!this._done) {
+            this._queryInfo(this.INFO_RETRY);
+        }
+        return;
+    }
+    this._requestedEnd = Math.min(from + this.BLOCK_SIZE, this._chunkCount);
+    this._lastRequestId += 1;
+    this._wsManager.SendCommand("GETAUDIO", {
+        id: this._movieId,
+        from: from,
+        to: this._requestedEnd
+    }, this._lastRequestId);
+};
+
+AudioPlayer.prototype._addChunk = function(index, timestamp, pcm) {
+    var samples = pcm.byteLength / 2 / this._channels;
+    var view = new DataView(pcm.buffer, pcm.byteOffset, pcm.byteLength);
+    var buffer = this._ctx.createBuffer(this._channels, samples, this._sampleRate);
+    for (var c = 0; c < this._channels; c++) {
+        var channel = buffer.getChannelData(c);
+        for (var i = 0; i < samples; i++) {
+            channel[i] = view.getInt16((i * this._channels + c) * 2, true) / 32768;
+        }
+    }
+    this._chunks[index] = {
+        timestamp: timestamp,
+        buffer: buffer
+    };
+    this._received += 1;
+    if (this._received == this._requestedEnd) {
+        this._loadNextBlock();
+    }
+};
+
+// Schedules the chunks due within the lookahead, clockStart is the wall
+// time at which timestamp 0 is presented.
+AudioPlayer.prototype.Schedule = function(clockStart) {
+    if (this._ctx === undefined || this._sampleRate == 0) return;
+    var now = Date.now();
+    var position = now - clockStart;
+    if (this._next === undefined) {
+        // start with the chunk playing at the current position
+        this._next = 0;
+        while (this._chunks[this._next + 1] !== undefined && this._chunks[this._next + 1].timestamp <= position) {
+            this._next += 1;
+        }
+    }
+    var self = this;
+    for (var chunk = this._chunks[this._next]; chunk !== undefined && chunk.timestamp < position + this.LOOKAHEAD; chunk = this._chunks[this._next]) {
+        var when = this._ctx.currentTime + (chunk.timestamp - position) / 1000;
+        var offset = Math.max(0, this._ctx.currentTime - when);
+        this._next += 1;
+        if (offset >= chunk.buffer.duration) continue;
+
+        var source = this._ctx.createBufferSource();
+        source.buffer = chunk.buffer;
+        source.connect(this._ctx.destination);
+        source.onended = function() {
+            self._sources.splice(self._sources.indexOf(this), 1);
+        };
+        source.start(Math.max(when, this._ctx.currentTime), offset);
+        this._sources.push(source);
+    }
+};
+
+// Browsers only start audio in response to the user, call on play.
+AudioPlayer.prototype.Resume = function() {
+    if (this._ctx !== undefined && this._ctx.state == "suspended") {
+        this._ctx.resume();
+    }
+};
+
+// Stops whatever is scheduled, the next Schedule picks up at its clock.
+AudioPlayer.prototype.Stop = function() {
+    $.each(this._sources.slice(), function(i, source) {
+        source.stop();
+    });
+    this._sources = [];
+    this._next = undefined;
+};
+
 function VideoPlayer(elm, host) {
     this.BUFFER_SIZE = 100; // buffer 30 seconds, 30 fps
     this.CACHE_LIMIT = 30; // cache 2 seconds before start playing
     this.FETCH_LIMIT = 30; // start fetch next buffer when remaining is less than 5 seconds
+    this.CHAR_WIDTH = 4; // approximate width in px of a char at the player's font size
+    this.DEFAULT_FRAME_RATE = 30; // used when the movie does not tell its frame rate
 
     this._wrapperElm = elm;
     this._frameElm = elm.find("#frame");
     this._notificationElm = elm.find("#notification");
     this._playBtn = elm.find("#play-btn");
+    this._movieSelect = elm.find("#movie-select");
 
     this._playingState = 0; // 0: stop, 1: allow to play
     this._isPlaying = 0; // 0: stop, 1: playing
 
+    this._movieId = undefined;
+    this._frameRate = 0;
     this._totalFrames = 0;
     this._bufferedFrames = 0;
     this._currentFrame = 0;
@@ -150,14 +425,20 @@ function VideoPlayer(elm, host) {
     this._buffer.onChanged = this._onBufferChanged.bind(this);
 
     this._wsManager = new WSManager(host);
+    this._audio = new AudioPlayer(this._wsManager);
 
     this._timer = undefined;
+    this._clockStart = undefined; // wall time at which timestamp 0 is presented
+
+    this._lastRequestId = 0;
+    this._movieRequestId = 1; // frames of earlier requests belong to another movie
 }
 
 VideoPlayer.prototype.init = function() {
     var self = this;
 
     Debug.Log("Begin initialization...");
+    this._audio.Init();
 
     // hook up events
     this._playBtn.click(function(ev) {
@@ -174,17 +455,58 @@ VideoPlayer.prototype.init = function() {
         }
     });
 
+    this._movieSelect.change(function(ev) {
+        Debug.Log("Movie changed to: " + self._movieSelect.val());
+        self._selectMovie(self._movieSelect.val());
+    });
+
+    this._wsManager.RegisterHandler("LISTMOVIES", function(data) {
+        self._movieSelect.empty();
+        // movies the server failed to decode cannot be played
+        var movies = $.grep(data.Movies, function(movie) {
+            return !movie.Failed;
+        });
+        $.each(movies, function(i, movie) {
+            self._movieSelect.append($("<option>").val(movie.Id).text(movie.Id));
+        });
+        Debug.Log("Got movie list, count: " + movies.length);
+
+        if (movies.length > 0) {
+            self._selectMovie(movies[0].Id);
+        }
+    });
+
     this._wsManager.RegisterHandler("GETFRAMECOUNT", function(data) {
+        if (data.Id !== self._movieId) return;
         self._totalFrames = data.FrameCount;
-        Debug.Log("Got total frame count: " + self._totalFrames);
+        self._frameRate = data.FrameRate;
+        Debug.Log("Got total frame count: " + self._totalFrames + ", converted: " + data.ConvertedFrames + ", fps: " + data.FrameRate);
+
+        if (self._totalFrames == 0 && !data.Done) {
+            // frame count is unknown until the server has converted the movie
+            window.setTimeout(function() {
+                self._wsManager.SendCommand("GETFRAMECOUNT", {
+                    id: data.Id
+                });
+            }, 1000);
+            return;
+        }
 
         // start loading
         self._loadNextBlock();
     });
 
-    this._wsManager.RegisterHandler("GETDATA", function(data) {
+    this._wsManager.RegisterBinaryHandler("GETDATA", function(data) {
+        // drop frames still in flight for a previously selected movie
+        if (data.RequestId < self._movieRequestId) return;
         self._bufferedFrames += 1;
-        if (!self._buffer.Enqueue(data.Frame)) {
+        var item = {
+            frame: data.Frame,
+            codec: data.Codec,
+            keyframe: data.Keyframe,
+            timestamp: data.Timestamp // ms
+        };
+        if (!self._buffer.Enqueue(item)) {
             Debug.Log("WARNING: buffer is full");
         }
     });
@@ -193,9 +515,41 @@ VideoPlayer.prototype.init = function() {
         self._displayErrorMessage(data)
     });
 
-    self._wsManager.Connect(function() {
-        self._wsManager.SendCommand("GETFRAMECOUNT");
+    // the server picks the nearest width it renders
+    var cols = Math.floor(this._wrapperElm.width() / this.CHAR_WIDTH);
+    self._wsManager.Connect({
+        cols: cols,
+        mode: "binary",
+        codecs: FrameCodecs.NAMES.join(","),
+        deltas: 1
+    }, function() {
+        self._wsManager.SendCommand("LISTMOVIES");
+    });
+};
+
+VideoPlayer.prototype._selectMovie = function(movieId) {
+    this._pause();
+    this._playBtn.html("Play");
+    this._frameElm.html("");
+    while (this._buffer.Dequeue() !== undefined);
+
+    this._movieId = movieId;
+    this._lastFrame = undefined;
+    this._playingState = 0;
+    this._frameRate = 0;
+    this._totalFrames = 0;
+    this._bufferedFrames = 0;
+    this._currentFrame = 0;
+    this._bufferEndFrame = 0;
+
+    this._movieSelect.val(movieId);
+    this._movieRequestId = this._lastRequestId + 1;
+    // stop the server sending frames of the previous movie
+    this._wsManager.SendCommand("CANCEL");
+    this._wsManager.SendCommand("GETFRAMECOUNT", {
+        id: movieId
     });
+    this._audio.Load(movieId);
 };
 
 VideoPlayer.prototype._displayErrorMessage = function(errData) {
@@ -234,35 +588,73 @@ VideoPlayer.prototype._loadNextBlock = function() {
     if (!this._hasMoreData()) return;
 
     var toFrame = Math.min(this._bufferEndFrame + this.BUFFER_SIZE, this._totalFrames);
+    this._lastRequestId += 1;
     this._wsManager.SendCommand("GETDATA", {
+        id: this._movieId,
         from: this._bufferEndFrame,
         to: toFrame
-    });
+    }, this._lastRequestId);
     this._bufferEndFrame = toFrame;
 };
 
+VideoPlayer.prototype._frameInterval = function() {
+    return 1000 / (this._frameRate > 0 ? this._frameRate : this.DEFAULT_FRAME_RATE);
+};
+
 VideoPlayer.prototype._play = function() {
-    var self = this;
     this._isPlaying = 1;
-    this._timer = window.setInterval(function() {
-        if (self._playingState == 1) {
-            var frame = self._buffer.Dequeue();
-            if (frame !== undefined) {
-		        var raw = atob(frame);
-		        var h = pako.ungzip(raw, {
-		           to: 'string'
-		        });
-                self._frameElm.html(h);
-                self._currentFrame += 1;
+    this._audio.Resume();
+    this._clockStart = undefined;
+    this._tick();
+};
+
+// Shows the next frame, and schedules the one after it at its timestamp.
+VideoPlayer.prototype._tick = function() {
+    var delay = this._frameInterval();
+    if (this._playingState == 1) {
+        var item = this._buffer.Dequeue();
+        if (item !== undefined) {
+            if (this._clockStart === undefined) {
+                this._clockStart = Date.now() - item.timestamp;
+            }
+            var h = FrameCodecs.Decode(item.codec, item.frame);
+            if (!item.keyframe) {
+                h = this._applyDelta(JSON.parse(h));
+            }
+            this._lastFrame = h;
+            this._frameElm.html(h);
+            this._currentFrame += 1;
+            this._audio.Schedule(this._clockStart);
+
+            var next = this._buffer.Peek();
+            if (next !== undefined) {
+                delay = Math.max(0, this._clockStart + next.timestamp - Date.now());
             }
         }
-    }, 33);
+    } else {
+        // waiting for frames, continue from where we stopped once cached
+        this._clockStart = undefined;
+        this._audio.Stop();
+    }
+    this._timer = window.setTimeout(this._tick.bind(this), delay);
+};
+
+// Rebuilds a frame from the rows that changed since the frame before.
+VideoPlayer.prototype._applyDelta = function(delta) {
+    var rows = this._lastFrame.split(delta.Separator);
+    rows.length = delta.Rows;
+    for (var i = 0; i < delta.Index.length; i++) {
+        rows[delta.Index[i]] = delta.Content[i];
+    }
+    return rows.join(delta.Separator);
 };
 
 VideoPlayer.prototype._pause = function() {
     this._isPlaying = 0;
+    this._clockStart = undefined;
+    this._audio.Stop();
     if (this._timer !== undefined) {
-        clearInterval(this._timer);
+        clearTimeout(this._timer);
         this._timer = undefined;
     }
 };
\ No newline at end of file
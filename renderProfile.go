@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// RenderProfile holds the libcaca dithering options used to turn images into
+// characters. Every profile is converted and cached separately.
+type RenderProfile struct {
+	Algorithm  string  `json:"algorithm"` // none, ordered2, ordered4, ordered8, random, fstein
+	Color      string  `json:"color"`     // mono, gray, 8, 16, fullgray, full8, full16
+	Charset    string  `json:"charset"`   // ascii, shades, blocks
+	Antialias  string  `json:"antialias"` // none, prefilter
+	Brightness float64 `json:"brightness"`
+	Gamma      float64 `json:"gamma"`
+	Contrast   float64 `json:"contrast"`
+	Scaler     string  `json:"scaler"` // point, bilinear, area, lanczos
+}
+
+const defaultProfileName = "default"
+
+// grayscale and undithered, downscaled with the area filter
+var DefaultRenderProfile = &RenderProfile{
+	Algorithm:  "none",
+	Color:      "fullgray",
+	Charset:    "ascii",
+	Antialias:  "prefilter",
+	Brightness: 1.0,
+	Gamma:      1.0,
+	Contrast:   1.0,
+	Scaler:     "area",
+}
+
+// UnmarshalJSON fills unspecified options from DefaultRenderProfile.
+func (this *RenderProfile) UnmarshalJSON(content []byte) error {
+	type plain RenderProfile
+	profile := plain(*DefaultRenderProfile)
+	if err := strictUnmarshal(content, &profile); err != nil {
+		return err
+	}
+	*this = RenderProfile(profile)
+	return nil
+}
+
+func (this *RenderProfile) Apply(dither *CacaDither) error {
+	if err := dither.SetAlgorithm(this.Algorithm); err != nil {
+		return fmt.Errorf("Invalid algorithm %q: %v", this.Algorithm, err)
+	}
+	if err := dither.SetColor(this.Color); err != nil {
+		return fmt.Errorf("Invalid color %q: %v", this.Color, err)
+	}
+	if err := dither.SetCharset(this.Charset); err != nil {
+		return fmt.Errorf("Invalid charset %q: %v", this.Charset, err)
+	}
+	if err := dither.SetAntialias(this.Antialias); err != nil {
+		return fmt.Errorf("Invalid antialias %q: %v", this.Antialias, err)
+	}
+	if err := dither.SetBrightness(this.Brightness); err != nil {
+		return fmt.Errorf("Invalid brightness %v: %v", this.Brightness, err)
+	}
+	if err := dither.SetGamma(this.Gamma); err != nil {
+		return fmt.Errorf("Invalid gamma %v: %v", this.Gamma, err)
+	}
+	if err := dither.SetContrast(this.Contrast); err != nil {
+		return fmt.Errorf("Invalid contrast %v: %v", this.Contrast, err)
+	}
+	return nil
+}
+
+// Validate checks the profile's options against what libcaca supports.
+func (this *RenderProfile) Validate() error {
+	catalog := GetDitherCatalog()
+	for _, option := range []struct {
+		name   string
+		value  string
+		values []CacaOption
+	}{
+		{"algorithm", this.Algorithm, catalog.Algorithms},
+		{"color", this.Color, catalog.Colors},
+		{"charset", this.Charset, catalog.Charsets},
+		{"antialias", this.Antialias, catalog.Antialias},
+	} {
+		if !containsOption(option.values, option.value) {
+			return fmt.Errorf("Invalid %s %q", option.name, option.value)
+		}
+	}
+	// libcaca stores brightness and contrast as given, but rejects a gamma
+	// that is not positive
+	if !(this.Gamma > 0) {
+		return fmt.Errorf("Invalid gamma %v", this.Gamma)
+	}
+	if _, err := scaleFilter(this.Scaler); err != nil {
+		return err
+	}
+	return nil
+}
+
+func containsOption(options []CacaOption, name string) bool {
+	for _, option := range options {
+		if option.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// DitherCatalog lists the values libcaca accepts for each dither setting.
+type DitherCatalog struct {
+	Algorithms []CacaOption
+	Colors     []CacaOption
+	Charsets   []CacaOption
+	Antialias  []CacaOption
+}
+
+var (
+	ditherCatalog     *DitherCatalog
+	ditherCatalogOnce sync.Once
+)
+
+// GetDitherCatalog queries libcaca once for the supported dither values.
+func GetDitherCatalog() *DitherCatalog {
+	ditherCatalogOnce.Do(func() {
+		dither := NewCacaDither(24, 1, 1)
+		defer dither.Free()
+		ditherCatalog = &DitherCatalog{
+			Algorithms: dither.AlgorithmList(),
+			Colors:     dither.ColorList(),
+			Charsets:   dither.CharsetList(),
+			Antialias:  dither.AntialiasList(),
+		}
+	})
+	return ditherCatalog
+}
+
+// getRenderProfile looks up a configured profile by name.
+func getRenderProfile(name string) (*RenderProfile, error) {
+	if profile, ok := config.Profiles[name]; ok {
+		return profile, nil
+	}
+	if name == defaultProfileName {
+		return DefaultRenderProfile, nil
+	}
+	return nil, errors.New("Unknown profile: " + name)
+}
+
+// movieProfileName returns the profile a movie is rendered with unless the
+// client picks another one.
+func movieProfileName(movieId string) string {
+	if name, ok := config.MovieProfiles[movieId]; ok {
+		return name
+	}
+	return defaultProfileName
+}
@@ -0,0 +1,765 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrFrameNotReady   = errors.New("Frame not converted yet")
+	ErrFrameOutOfRange = errors.New("Frame out of range")
+	ErrCancelled       = errors.New("Request cancelled")
+)
+
+// Rendition gives access to the converted frames of a movie, which live in
+// a frame store on disk. It is filled by a background transcoding job while
+// clients are already reading from it.
+type Rendition struct {
+	mutex       sync.Mutex
+	cond        *sync.Cond
+	store       *FrameStore
+	converted   int
+	totalFrames int     // estimated from the container until done
+	frameRate   float64 // estimated from the container until a store is set
+	done        bool
+	err         error
+	degraded    bool   // the cache was corrupt and is being rebuilt
+	generation  int    // counts the stores frames were read from
+	busy        bool   // a transcoding job is running for this rendition
+	pending     bool   // a rebuild is due once the running job is done
+	rebuild     func() // queues a job that quarantines and rebuilds the cache
+
+	// stores are closed once replaced and no longer read from
+	readers map[*FrameStore]int
+	retired map[*FrameStore]bool
+}
+
+func NewRendition(totalFrames int, frameRate float64) *Rendition {
+	r := &Rendition{
+		totalFrames: totalFrames,
+		frameRate:   frameRate,
+		readers:     make(map[*FrameStore]int),
+		retired:     make(map[*FrameStore]bool),
+	}
+	r.cond = sync.NewCond(&r.mutex)
+	return r
+}
+
+// setStore replaces the store frames are read from. The mutex must be held.
+func (this *Rendition) setStore(store *FrameStore) {
+	if old := this.store; old != nil && old != store {
+		if this.readers[old] == 0 {
+			old.Close()
+		} else {
+			this.retired[old] = true
+		}
+	}
+	if store != this.store {
+		this.generation++
+	}
+	this.store = store
+}
+
+// acquire marks a read of store in flight. The mutex must be held.
+func (this *Rendition) acquire(store *FrameStore) {
+	this.readers[store]++
+}
+
+// release ends a read of store, closing it if it was replaced meanwhile.
+func (this *Rendition) release(store *FrameStore) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.readers[store]--
+	if this.readers[store] > 0 {
+		return
+	}
+	delete(this.readers, store)
+	if this.retired[store] {
+		delete(this.retired, store)
+		store.Close()
+	}
+}
+
+// Start sets the store that frames are about to be appended to.
+func (this *Rendition) Start(store *FrameStore) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.setStore(store)
+	this.converted = 0
+	this.frameRate = store.Header().FrameRate
+}
+
+// Load serves all frames from a finished store.
+func (this *Rendition) Load(store *FrameStore) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.setStore(store)
+	this.converted = store.FrameCount()
+	this.frameRate = store.Header().FrameRate
+	this.done = true
+	this.degraded = false
+	this.totalFrames = this.converted
+	this.cond.Broadcast()
+}
+
+// Degrade stops serving a corrupt store and has it rebuilt, as soon as the
+// job running for the rendition, if any, is done. Readers wait for the
+// rebuilt frames. It returns false if the store is still being written, so
+// there is nothing to retry.
+func (this *Rendition) Degrade(store *FrameStore, reason error) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.store != store {
+		return true
+	}
+	if !this.done {
+		return false
+	}
+	log.Println("Frame store corrupt, rebuilding:", reason)
+	// the corrupt store is closed once the last read of it is done
+	this.setStore(nil)
+	this.converted = 0
+	this.done = false
+	this.err = nil
+	this.degraded = true
+	if this.busy {
+		this.pending = true
+	} else if this.rebuild != nil {
+		this.rebuild()
+	}
+	return true
+}
+
+// setBusy tells whether a job is running. A rebuild requested while it ran
+// is queued when it is done.
+func (this *Rendition) setBusy(busy bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.busy = busy
+	if !busy && this.pending {
+		this.pending = false
+		if this.rebuild != nil {
+			this.rebuild()
+		}
+	}
+}
+
+func (this *Rendition) Append(frame StoredFrame) error {
+	if err := this.store.Append(frame); err != nil {
+		return err
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.converted++
+	if this.converted > this.totalFrames {
+		this.totalFrames = this.converted
+	}
+	this.cond.Broadcast()
+	return nil
+}
+
+// Finish marks the rendition complete. The frame count becomes exact.
+func (this *Rendition) Finish(err error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.done = true
+	this.err = err
+	this.degraded = false
+	this.totalFrames = this.converted
+	this.cond.Broadcast()
+}
+
+// Fail marks the rendition failed with err. If store, which a job aborted,
+// was being served its frames are dropped, and it is closed once the last
+// read of it is done. Frames of any other store are still served.
+func (this *Rendition) Fail(store *FrameStore, err error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if store != nil && this.store == store {
+		this.setStore(nil)
+		this.converted = 0
+	}
+	this.done = true
+	this.err = err
+	this.degraded = false
+	this.totalFrames = this.converted
+	this.cond.Broadcast()
+}
+
+// Wait blocks until the rendition is done, and returns why it failed.
+func (this *Rendition) Wait() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for !this.done {
+		this.cond.Wait()
+	}
+	return this.err
+}
+
+// Counts returns the total and converted number of frames.
+func (this *Rendition) Counts() (total int, converted int, done bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.totalFrames, this.converted, this.done
+}
+
+// FrameRate returns the average number of frames per second, or 0 if the
+// movie does not tell. Frames are presented at their own timestamps, this is
+// only a hint.
+func (this *Rendition) FrameRate() float64 {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.frameRate
+}
+
+// Header returns the header of the store frames are read from, or false if
+// there is none yet.
+func (this *Rendition) Header() (FrameStoreHeader, bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.store == nil {
+		return FrameStoreHeader{}, false
+	}
+	return this.store.Header(), true
+}
+
+func (this *Rendition) Degraded() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.degraded
+}
+
+func (this *Rendition) Err() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.err
+}
+
+// storeFor returns the store that holds frame i and its generation. The
+// store must be released once read from. When the frame is not converted yet it either blocks until
+// it is, or returns ErrFrameNotReady if wait is false. Closing cancel stops
+// waiting, provided Interrupt is called afterwards.
+func (this *Rendition) storeFor(i int, wait bool, cancel <-chan struct{}) (*FrameStore, int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for i >= this.converted {
+		if this.done {
+			if this.err != nil {
+				return nil, 0, this.err
+			}
+			return nil, 0, ErrFrameOutOfRange
+		}
+		if !wait {
+			return nil, 0, ErrFrameNotReady
+		}
+		select {
+		case <-cancel:
+			return nil, 0, ErrCancelled
+		default:
+		}
+		this.cond.Wait()
+	}
+	this.acquire(this.store)
+	return this.store, this.generation, nil
+}
+
+// Interrupt wakes readers waiting for frames, so they notice they were
+// cancelled.
+func (this *Rendition) Interrupt() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.cond.Broadcast()
+}
+
+// Frame reads frame i. When the frame is not converted yet it either blocks
+// until it is, or returns ErrFrameNotReady if wait is false. A corrupt frame
+// degrades the rendition and is read again once rebuilt.
+func (this *Rendition) Frame(i int, wait bool) (StoredFrame, error) {
+	frame, _, err := this.ReadFrame(i, wait, nil)
+	return frame, err
+}
+
+// ReadFrame is Frame that also returns the generation of the store the
+// frame was read from. It changes whenever the store is replaced, after which
+// deltas no longer apply to earlier frames. Waiting stops with ErrCancelled
+// once cancel is closed and the rendition interrupted.
+func (this *Rendition) ReadFrame(i int, wait bool, cancel <-chan struct{}) (StoredFrame, int, error) {
+	for {
+		store, generation, err := this.storeFor(i, wait, cancel)
+		if err != nil {
+			return StoredFrame{}, 0, err
+		}
+		frame, err := store.ReadFrame(i)
+		this.release(store)
+		if err != ErrFrameChecksum && err != ErrFrameStoreTruncated {
+			return frame, generation, err
+		}
+		if !this.Degrade(store, err) {
+			return StoredFrame{}, 0, err
+		}
+	}
+}
+
+// Timestamp returns when frame i is presented, or ErrFrameNotReady if it is
+// not converted yet.
+func (this *Rendition) Timestamp(i int) (time.Duration, error) {
+	store, _, err := this.storeFor(i, false, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer this.release(store)
+	return store.Timestamp(i)
+}
+
+// FrameAt returns the index of the converted frame presented at timestamp.
+func (this *Rendition) FrameAt(timestamp time.Duration) int {
+	this.mutex.Lock()
+	store, converted := this.store, this.converted
+	if converted == 0 {
+		this.mutex.Unlock()
+		return 0
+	}
+	this.acquire(store)
+	this.mutex.Unlock()
+	defer this.release(store)
+
+	// the first frame presented after timestamp
+	i := sort.Search(converted, func(i int) bool {
+		t, err := store.Timestamp(i)
+		return err != nil || t > timestamp
+	})
+	if i > 0 {
+		i--
+	}
+	return i
+}
+
+// RenditionKey identifies one way of rendering a movie. Each key is
+// converted and cached separately.
+type RenditionKey struct {
+	Format  CacaExportFormat
+	Cols    int
+	Profile string
+	Codec   string
+}
+
+func (this RenditionKey) String() string {
+	return fmt.Sprintf("%s.%d.%s.%s", this.Format, this.Cols, this.Profile, this.Codec)
+}
+
+type TranscodeJob struct {
+	Entry      *MovieEntry
+	Key        RenditionKey
+	Rendition  *Rendition
+	Quarantine bool // the existing cache is known to be corrupt
+	Audio      bool // extract the audio track, only Key.Codec applies
+}
+
+// Settings describes how the job renders its frames. A cache made with
+// other settings is rebuilt.
+func (this *TranscodeJob) Settings() string {
+	if this.Audio {
+		return "audio.s16le." + this.Key.Codec
+	}
+	return this.Key.String()
+}
+
+// TranscodeQueue runs transcoding jobs on a fixed pool of workers, in the
+// order they were submitted.
+type TranscodeQueue struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	jobs  []*TranscodeJob
+}
+
+func NewTranscodeQueue(workers int) *TranscodeQueue {
+	queue := new(TranscodeQueue)
+	queue.cond = sync.NewCond(&queue.mutex)
+	for i := 0; i < workers; i++ {
+		go queue.work()
+	}
+	return queue
+}
+
+func (this *TranscodeQueue) Submit(job *TranscodeJob) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.jobs = append(this.jobs, job)
+	this.cond.Signal()
+}
+
+func (this *TranscodeQueue) next() *TranscodeJob {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for len(this.jobs) == 0 {
+		this.cond.Wait()
+	}
+	job := this.jobs[0]
+	this.jobs = this.jobs[1:]
+	return job
+}
+
+func (this *TranscodeQueue) work() {
+	for {
+		transcode(this.next())
+	}
+}
+
+// SourceInfo identifies the content of a source movie.
+type SourceInfo struct {
+	Path    string
+	Size    int64
+	ModTime int64 // unix nanoseconds
+	Hash    string
+}
+
+// statSource gets the size and modification time of a movie. The hash is
+// only computed when needed, as that reads the whole file.
+func statSource(path string) (SourceInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return SourceInfo{}, err
+	}
+	return SourceInfo{Path: path, Size: info.Size(), ModTime: info.ModTime().UnixNano()}, nil
+}
+
+// staleReason explains why frames stored with header cannot be served for
+// the given source and settings, or returns "" if they can. The source is
+// only hashed when its size or modification time differ, so a file that was
+// merely touched is not converted again.
+func staleReason(header FrameStoreHeader, source *SourceInfo, settings string) string {
+	if header.Settings != settings {
+		return "settings changed from " + header.Settings
+	}
+	if header.SourceSize == source.Size && header.SourceModTime == source.ModTime {
+		return ""
+	}
+	if source.Hash == "" {
+		hash, err := hashFile(source.Path)
+		if err != nil {
+			return "cannot hash source: " + err.Error()
+		}
+		source.Hash = hash
+	}
+	if header.SourceHash != source.Hash {
+		return "source changed"
+	}
+	return ""
+}
+
+func cachePathFor(entry *MovieEntry, settings string) string {
+	return entry.Path + "." + settings + ".cache"
+}
+
+// frameRenderer produces the frames of a transcoding job.
+type frameRenderer interface {
+	// StaleReason explains why a cache made with header cannot be served,
+	// beyond a change of source or settings, or returns "".
+	StaleReason(header FrameStoreHeader) string
+	// Start decodes the source, and fills in what it knows of the header.
+	Start(source string, header *FrameStoreHeader) error
+	// Next returns the next frame to store, or io.EOF after the last one.
+	Next() (StoredFrame, error)
+	Close()
+}
+
+// newFrameRenderer is a variable so tests can render without decoding.
+var newFrameRenderer = func(job *TranscodeJob, codec FrameCodec) (frameRenderer, error) {
+	if job.Audio {
+		return &audioRenderer{codec: codec}, nil
+	}
+	profile, err := getRenderProfile(job.Key.Profile)
+	if err != nil {
+		return nil, err
+	}
+	return &movieRenderer{key: job.Key, profile: profile, codec: codec}, nil
+}
+
+// movieRenderer converts video frames to ASCII art.
+type movieRenderer struct {
+	key       RenditionKey
+	profile   *RenderProfile
+	codec     FrameCodec
+	source    string
+	movie     *Movie
+	converter *AsciiConverter
+	deltas    *DeltaEncoder
+}
+
+func (this *movieRenderer) StaleReason(header FrameStoreHeader) string {
+	if header.Profile == nil || *header.Profile != *this.profile {
+		return "profile changed"
+	}
+	if header.KeyframeInterval != config.KeyframeInterval {
+		return "keyframe interval changed"
+	}
+	if header.ImageWidth == 0 {
+		return "rendered from full size images"
+	}
+	return ""
+}
+
+func (this *movieRenderer) Start(source string, header *FrameStoreHeader) error {
+	movie, err := loadMovie(source, imageScale(this.key.Cols, this.profile))
+	if err != nil {
+		return &DecodeError{source, err}
+	}
+	this.source, this.movie = source, movie
+	converter, err := NewAsciiConverter(movie, this.key.Cols, this.profile)
+	if err != nil {
+		return err
+	}
+	this.converter = converter
+	this.deltas = NewDeltaEncoder(this.key.Format, config.KeyframeInterval)
+	header.Profile = this.profile
+	header.KeyframeInterval = config.KeyframeInterval
+	header.FrameRate = movie.FrameRate
+	header.ImageWidth, header.ImageHeight = movie.Width, movie.Height
+	return nil
+}
+
+func (this *movieRenderer) Next() (StoredFrame, error) {
+	image, more := <-this.movie.ImageStream
+	if !more {
+		if corrupt := this.movie.CorruptPackets(); corrupt > 0 {
+			log.Println("Skipped corrupt packets:", this.source, corrupt)
+		}
+		if err := this.movie.Err(); err != nil {
+			return StoredFrame{}, err
+		}
+		return StoredFrame{}, io.EOF
+	}
+	output, err := this.converter.Convert(this.key.Format, image)
+	image.Release()
+	if err != nil {
+		return StoredFrame{}, err
+	}
+
+	content, keyframe, err := this.deltas.Encode(output)
+	if err != nil {
+		return StoredFrame{}, err
+	}
+	payload, err := this.codec.Encode(content)
+	if err != nil {
+		return StoredFrame{}, err
+	}
+	return StoredFrame{payload, image.Timestamp, this.codec.Id(), keyframe}, nil
+}
+
+func (this *movieRenderer) Close() {
+	if this.movie != nil {
+		// let the decoder run to completion so it releases its resources
+		for image := range this.movie.ImageStream {
+			image.Release()
+		}
+	}
+	if this.converter != nil {
+		this.converter.Free()
+	}
+}
+
+// audioRenderer stores the audio track in chunks of PCM.
+type audioRenderer struct {
+	codec FrameCodec
+	track *AudioTrack
+}
+
+func (this *audioRenderer) StaleReason(header FrameStoreHeader) string {
+	return ""
+}
+
+func (this *audioRenderer) Start(source string, header *FrameStoreHeader) error {
+	track, err := loadAudio(source)
+	if err != nil {
+		return err
+	}
+	this.track = track
+	header.SampleRate = track.SampleRate
+	header.Channels = track.Channels
+	header.FrameRate = audioChunkRate
+	return nil
+}
+
+func (this *audioRenderer) Next() (StoredFrame, error) {
+	chunk, more := <-this.track.ChunkStream
+	if !more {
+		return StoredFrame{}, io.EOF
+	}
+	payload, err := this.codec.Encode(chunk.Data)
+	if err != nil {
+		return StoredFrame{}, err
+	}
+	return StoredFrame{payload, chunk.Timestamp, this.codec.Id(), true}, nil
+}
+
+func (this *audioRenderer) Close() {
+	if this.track != nil {
+		for range this.track.ChunkStream {
+		}
+	}
+}
+
+func transcode(job *TranscodeJob) {
+	entry, rendition := job.Entry, job.Rendition
+	settings := job.Settings()
+	log.Println("transcoding movie:", entry.Path, "rendition:", settings)
+	cachePath := cachePathFor(entry, settings)
+
+	rendition.setBusy(true)
+	defer rendition.setBusy(false)
+
+	// another replica may be building the same cache, wait for it to finish
+	lock, err := AcquireFileLock(cachePath, time.Duration(config.LockTimeout)*time.Second)
+	if err != nil {
+		log.Println("Cannot lock cache:", cachePath, err)
+		rendition.Finish(err)
+		return
+	}
+	defer func() {
+		if err := lock.Release(); err != nil {
+			log.Println("Cannot unlock cache:", cachePath, err)
+		}
+	}()
+
+	if job.Quarantine {
+		quarantineCache(cachePath)
+	}
+
+	// a stale cache keeps being served until its replacement is finished
+	var staleStore *FrameStore
+	// the store being written, discarded on failure
+	var building *FrameStore
+	// frames of a stale cache are still served after a failure, the partial
+	// frames of the discarded store are not
+	fail := func(err error) {
+		log.Println("transcoding failed:", entry.Id, "rendition:", settings, err)
+		if building != nil {
+			building.Abort()
+			if staleStore != nil {
+				building.Close()
+			}
+		}
+		rendition.Fail(building, err)
+	}
+
+	codec, err := GetFrameCodec(job.Key.Codec)
+	if err != nil {
+		fail(err)
+		return
+	}
+	renderer, err := newFrameRenderer(job, codec)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer renderer.Close()
+	source, err := statSource(entry.Path)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	store, err := OpenFrameStore(cachePath)
+	switch {
+	case err == nil:
+		reason := staleReason(store.Header(), &source, settings)
+		if reason == "" {
+			reason = renderer.StaleReason(store.Header())
+		}
+		if reason == "" {
+			rendition.Load(store)
+			log.Println("transcoding done:", entry.Id, "rendition:", settings, "loaded from cache")
+			return
+		}
+		log.Println("Rebuilding stale cache:", cachePath, reason)
+		rendition.Load(store)
+		staleStore = store
+	case os.IsNotExist(err):
+	case err == ErrFrameStoreFormat || err == ErrFrameStoreVersion:
+		log.Println("Rebuilding cache:", cachePath, err)
+	case IsFrameStoreCorrupt(err):
+		log.Println("Rebuilding corrupt cache:", cachePath, err)
+		quarantineCache(cachePath)
+	default:
+		// the cache may be fine, but cannot be read now
+		fail(err)
+		return
+	}
+
+	if source.Hash == "" {
+		if source.Hash, err = hashFile(entry.Path); err != nil {
+			fail(err)
+			return
+		}
+	}
+	header := FrameStoreHeader{
+		SourceHash:    source.Hash,
+		SourceSize:    source.Size,
+		SourceModTime: source.ModTime,
+		Settings:      settings,
+		Compression:   codec.Name(),
+	}
+	if err := renderer.Start(entry.Path, &header); err != nil {
+		fail(err)
+		return
+	}
+
+	store, err = CreateFrameStore(cachePath, header)
+	if err != nil {
+		fail(err)
+		return
+	}
+	building = store
+	if staleStore == nil {
+		rendition.Start(store)
+	}
+
+	frameCount := 0
+	for {
+		frame, err := renderer.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			if staleStore == nil {
+				err = rendition.Append(frame)
+			} else {
+				err = store.Append(frame)
+			}
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		if frameCount%100 == 0 {
+			log.Println("Loading frame:", entry.Id, settings, frameCount)
+		}
+		frameCount++
+	}
+	if err := store.Finish(); err != nil {
+		fail(err)
+		return
+	}
+	if staleStore == nil {
+		rendition.Finish(nil)
+	} else {
+		// the stale store is closed once the last read of it is done
+		rendition.Load(store)
+	}
+	log.Println("transcoding done:", entry.Id, "rendition:", settings)
+}
+
+func quarantineCache(cachePath string) {
+	if quarantinePath, err := quarantineFile(cachePath); err == nil {
+		log.Println("Quarantined corrupt cache:", quarantinePath)
+	} else if !os.IsNotExist(err) {
+		log.Println("Cannot quarantine corrupt cache:", cachePath, err)
+	}
+}
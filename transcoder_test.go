@@ -0,0 +1,326 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// finishedFrameStore writes a store of count keyframes to path and opens it.
+func finishedFrameStore(t *testing.T, path string, count int) *FrameStore {
+	store, err := CreateFrameStore(path, FrameStoreHeader{FrameRate: 25})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		if err := store.Append(StoredFrame{[]byte(fmt.Sprint("frame ", i)), time.Duration(i) * 40 * time.Millisecond, 0, true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	store, err = OpenFrameStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestRenditionClosesReplacedStoreAfterLastRead(t *testing.T) {
+	path := tempFrameStorePath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	stale := finishedFrameStore(t, path, 3)
+	fresh := finishedFrameStore(t, filepath.Join(filepath.Dir(path), "fresh.cache"), 3)
+	defer fresh.Close()
+
+	rendition := NewRendition(3, 25)
+	rendition.Load(stale)
+	store, _, err := rendition.storeFor(1, false, nil)
+	if err != nil || store != stale {
+		t.Fatal("Unexpected store:", store, err)
+	}
+
+	rendition.Load(fresh)
+	// the read in flight still works on the replaced store
+	if frame, err := store.ReadFrame(1); err != nil || string(frame.Payload) != "frame 1" {
+		t.Fatal("Replaced store closed while read:", frame, err)
+	}
+	rendition.release(store)
+	if _, err := stale.ReadFrame(1); err == nil {
+		t.Error("Replaced store not closed after the last read")
+	}
+	if frame, err := rendition.Frame(2, false); err != nil || string(frame.Payload) != "frame 2" {
+		t.Error("Unexpected frame:", frame, err)
+	}
+
+	// a store nobody reads is closed right away
+	other := finishedFrameStore(t, filepath.Join(filepath.Dir(path), "other.cache"), 3)
+	rendition.Load(other)
+	if _, err := fresh.ReadFrame(0); err == nil {
+		t.Error("Unread replaced store not closed")
+	}
+	other.Close()
+}
+
+func TestRenditionRebuildsAfterBusyJob(t *testing.T) {
+	path := tempFrameStorePath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	store := finishedFrameStore(t, path, 3)
+
+	rendition := NewRendition(3, 25)
+	rebuilds := 0
+	rendition.rebuild = func() { rebuilds++ }
+	// a job loaded the store and has not returned yet
+	rendition.setBusy(true)
+	rendition.Load(store)
+
+	if !rendition.Degrade(store, ErrFrameChecksum) {
+		t.Fatal("Finished store not degraded")
+	}
+	if rebuilds != 0 {
+		t.Fatal("Rebuild queued while the job runs")
+	}
+	if _, err := store.ReadFrame(0); err == nil {
+		t.Error("Corrupt store not closed")
+	}
+	rendition.setBusy(false)
+	if rebuilds != 1 {
+		t.Error("Unexpected rebuilds once the job is done:", rebuilds)
+	}
+	rendition.setBusy(true)
+	rendition.setBusy(false)
+	if rebuilds != 1 {
+		t.Error("Rebuild queued twice:", rebuilds)
+	}
+}
+
+// deltaFrameStore writes frames to path, encoded as keyframes and deltas.
+func deltaFrameStore(t *testing.T, path string, frames ...string) *FrameStore {
+	codec, err := GetFrameCodec("none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := CreateFrameStore(path, FrameStoreHeader{FrameRate: 25})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder := NewDeltaEncoder(CACA_EXPORT_FMT_ANSI, 50)
+	for i, frame := range frames {
+		content, keyframe, err := encoder.Encode(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keyframe != (i == 0) {
+			t.Fatal("Unexpected keyframe:", i, keyframe)
+		}
+		if err := store.Append(StoredFrame{content, time.Duration(i) * 40 * time.Millisecond, codec.Id(), keyframe}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestFrameAssemblerRestartsOnNewStore(t *testing.T) {
+	dir := filepath.Dir(tempFrameStorePath(t))
+	defer os.RemoveAll(dir)
+	// rows long enough for deltas to be worth it
+	rows := func(first string, last string) string {
+		row := strings.Repeat(".", 40)
+		return strings.Join([]string{first + row, row, row, row, last + row}, "\n")
+	}
+
+	for _, deltas := range []bool{true, false} {
+		stale := deltaFrameStore(t, filepath.Join(dir, fmt.Sprint(deltas, ".stale")), rows("a", "b"), rows("a", "c"))
+		fresh := deltaFrameStore(t, filepath.Join(dir, fmt.Sprint(deltas, ".fresh")), rows("x", "y"), rows("x", "z"))
+		rendition := NewRendition(2, 25)
+		rendition.Load(stale)
+		assembler := newFrameAssembler(rendition, CACA_EXPORT_FMT_ANSI)
+		frame, generation, err := rendition.ReadFrame(0, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := assembler.Next(0, generation, frame, deltas); err != nil {
+			t.Fatal(err)
+		}
+
+		// the rebuilt store replaces the stale one mid-stream
+		rendition.Load(fresh)
+		frame, generation, err = rendition.ReadFrame(1, false, nil)
+		if err != nil || frame.Keyframe {
+			t.Fatal("Expected a delta:", frame, err)
+		}
+		frame, err = assembler.Next(1, generation, frame, deltas)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !frame.Keyframe || string(frame.Payload) != rows("x", "z") {
+			t.Errorf("Deltas %v: unexpected frame: %v %q", deltas, frame.Keyframe, frame.Payload)
+		}
+		fresh.Close()
+	}
+}
+
+// fakeRenderer renders frames until it runs out, then returns end. It
+// blocks before that until proceed is closed.
+type fakeRenderer struct {
+	codec   FrameCodec
+	frames  int
+	end     error
+	proceed chan struct{}
+	stale   func(header FrameStoreHeader) string // nil if no cache is stale
+}
+
+func (this *fakeRenderer) StaleReason(header FrameStoreHeader) string {
+	if this.stale == nil {
+		return ""
+	}
+	return this.stale(header)
+}
+
+func (this *fakeRenderer) Start(source string, header *FrameStoreHeader) error {
+	header.FrameRate = 25
+	return nil
+}
+
+func (this *fakeRenderer) Next() (StoredFrame, error) {
+	if this.frames == 0 {
+		<-this.proceed
+		return StoredFrame{}, this.end
+	}
+	this.frames--
+	return StoredFrame{[]byte("frame"), 0, this.codec.Id(), true}, nil
+}
+
+func (this *fakeRenderer) Close() {}
+
+// useFakeRenderer makes transcode render with renderer until the returned
+// function is called.
+func useFakeRenderer(renderer *fakeRenderer) func() {
+	saved := newFrameRenderer
+	newFrameRenderer = func(job *TranscodeJob, codec FrameCodec) (frameRenderer, error) {
+		renderer.codec = codec
+		return renderer, nil
+	}
+	return func() { newFrameRenderer = saved }
+}
+
+// fakeSource writes a source movie to dir.
+func fakeSource(t *testing.T, dir string) *MovieEntry {
+	source := filepath.Join(dir, "movie.mp4")
+	if err := ioutil.WriteFile(source, []byte("movie"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &MovieEntry{Id: "movie", Path: source}
+}
+
+var errRendererFailed = errors.New("Renderer failed")
+
+func TestTranscodeFailureDropsPartialFrames(t *testing.T) {
+	path := tempFrameStorePath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	renderer := &fakeRenderer{frames: 2, end: errRendererFailed, proceed: make(chan struct{})}
+	defer useFakeRenderer(renderer)()
+
+	entry := fakeSource(t, filepath.Dir(path))
+	job := &TranscodeJob{entry, RenditionKey{CACA_EXPORT_FMT_ANSI, 80, "default", "none"}, NewRendition(2, 25), false, false}
+	done := make(chan struct{})
+	go func() {
+		transcode(job)
+		close(done)
+	}()
+	// a reader holds the partial store while the job fails
+	store, _, err := job.Rendition.storeFor(1, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(renderer.proceed)
+	<-done
+
+	if _, err := job.Rendition.Frame(0, false); err != errRendererFailed {
+		t.Error("Expected the renderer error, got:", err)
+	}
+	if frame, err := store.ReadFrame(1); err != nil || string(frame.Payload) != "frame" {
+		t.Error("Partial store closed while read:", frame, err)
+	}
+	job.Rendition.release(store)
+	if _, err := store.ReadFrame(1); err == nil {
+		t.Error("Partial store not closed after the last read")
+	}
+	if _, err := os.Stat(cachePathFor(entry, job.Settings()) + ".tmp"); !os.IsNotExist(err) {
+		t.Error("Partial store not removed:", err)
+	}
+
+	// a stale cache keeps being served
+	stale, err := CreateFrameStore(cachePathFor(entry, job.Settings()), FrameStoreHeader{FrameRate: 25, Settings: "stale"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stale.Append(StoredFrame{[]byte("stale"), 0, 0, true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stale.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	stale.Close()
+	renderer.frames = 2
+	job.Rendition = NewRendition(1, 25)
+	transcode(job)
+	if frame, err := job.Rendition.Frame(0, false); err != nil || string(frame.Payload) != "stale" {
+		t.Error("Stale frame not served after the failure:", frame, err)
+	}
+	if _, err := job.Rendition.Frame(1, false); err != errRendererFailed {
+		t.Error("Expected the renderer error, got:", err)
+	}
+}
+
+func TestTranscodeRebuildsCacheOfFullSizeImages(t *testing.T) {
+	path := tempFrameStorePath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	proceed := make(chan struct{})
+	close(proceed)
+	renderer := &fakeRenderer{frames: 1, end: io.EOF, proceed: proceed}
+	renderer.stale = (&movieRenderer{profile: DefaultRenderProfile}).StaleReason
+	defer useFakeRenderer(renderer)()
+
+	entry := fakeSource(t, filepath.Dir(path))
+	job := &TranscodeJob{entry, RenditionKey{CACA_EXPORT_FMT_ANSI, 80, defaultProfileName, "none"}, NewRendition(1, 25), false, false}
+	source, err := statSource(entry.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a cache written before images were scaled down, up to date otherwise
+	old, err := CreateFrameStore(cachePathFor(entry, job.Settings()), FrameStoreHeader{
+		SourceSize:       source.Size,
+		SourceModTime:    source.ModTime,
+		Settings:         job.Settings(),
+		Profile:          DefaultRenderProfile,
+		FrameRate:        25,
+		KeyframeInterval: config.KeyframeInterval,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Append(StoredFrame{[]byte("full size"), 0, 0, true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+
+	transcode(job)
+	if frame, err := job.Rendition.Frame(0, false); err != nil || string(frame.Payload) != "frame" {
+		t.Error("Cache of full size images served:", frame, err)
+	}
+}
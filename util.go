@@ -3,10 +3,11 @@ package main
 import "C"
 
 import (
-	"errors"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"log"
 	"os"
-	"path/filepath"
 	"runtime/debug"
 )
 
@@ -33,34 +34,24 @@ func checkFileExists(filePath string) (bool, error) {
 	}
 }
 
-func LockFile(filePath string) (bool, error) {
-	dir, file := filepath.Split(filePath)
-	if dir == filePath {
-		return false, errors.New("Cannot lock dirs")
-	}
-	if _, err := os.Stat(dir); err != nil {
-		return false, err
-	}
-	lockFileName := file + ".lock"
-	_, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_CREATE|os.O_EXCL, 0666)
+// hashFile returns the hex encoded sha256 of a file's content.
+func hashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
 	if err != nil {
-		return false, err
+		return "", err
 	}
-	return true, nil
-}
+	defer file.Close()
 
-func UnlockFile(filePath string) (bool, error) {
-	dir, file := filepath.Split(filePath)
-	if dir == filePath {
-		return false, errors.New("Cannot unlock dirs")
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
 	}
-	if _, err := os.Stat(dir); err != nil {
-		return false, err
-	}
-	lockFileName := file + ".lock"
-	err := os.Remove(filepath.Join(dir, lockFileName))
-	if err != nil && !os.IsNotExist(err) {
-		return false, err
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
 	}
-	return true, nil
+	return n
 }
@@ -1,10 +1,8 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
 	"encoding/base64"
-	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -12,134 +10,202 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
 	"sync"
 	"text/template"
+	"time"
 
 	"golang.org/x/net/websocket"
 )
 
-type CachingData struct {
-	VideoBuffer []string
-	FrameCount  int
-}
-
 var (
-	indexTmpl *template.Template
-	data      *CachingData
+	indexTmpl      *template.Template
+	library        *MovieLibrary
+	transcodeQueue *TranscodeQueue
 )
 
-func readFromCache(cacheFilePath string) {
-	cacheFile, err := os.Open(cacheFilePath)
-	if err != nil {
-		fatal(err)
-		// TODO: can fall back to read from origin and try recreate the cache
-	}
+// warmUp scans the movie library and queues every movie for transcoding.
+// Movies are probed in the background, so clients can connect meanwhile and
+// see each movie once it is probed. A movie that cannot be decoded is marked
+// as failed once its conversion stops, the others are served as usual.
+func warmUp() {
+	log.Println("warming up server...")
+	library = NewMovieLibrary()
+	transcodeQueue = NewTranscodeQueue(runtime.NumCPU())
+	go func() {
+		if err := library.Scan(config.ResourcesPath); err != nil {
+			fatal(err)
+		}
+		for _, id := range library.Ids() {
+			entry, _ := library.Get(id)
+			rendition := entry.Rendition(RenditionKey{defaultFormat, config.DefaultColumns, movieProfileName(entry.Id), movieCodecName(entry.Id)})
+			entry.Audio(movieCodecName(entry.Id))
+			go func() {
+				if err, ok := rendition.Wait().(*DecodeError); ok {
+					log.Println("Movie failed:", entry.Id, err)
+					entry.Fail(err)
+				}
+			}()
+		}
+		log.Println("warming up done, movies:", library.Ids())
+	}()
+}
 
-	dec := gob.NewDecoder(cacheFile)
-	localData := CachingData{}
-	err = dec.Decode(&localData)
+func root(w http.ResponseWriter, r *http.Request) {
+	var model = struct{ Host string }{config.WebsocketHost}
+	err := indexTmpl.Execute(w, model)
 	if err != nil {
-		fatal(err)
+		http.Error(w, err.Error(), 500)
 	}
-	data = &localData
 }
 
-func writeToCache(cacheFilePath string) {
-	cacheFileTmp := cacheFilePath + ".tmp"
-	cacheFileTmpFile, err := os.Create(cacheFileTmp)
-	if err != nil {
-		fatal(err)
-	}
-	enc := gob.NewEncoder(cacheFileTmpFile)
-	err = enc.Encode(data)
-	if err != nil {
-		fatal(err)
+// status reports conversion progress of every rendition, and whether any
+// of them is being rebuilt from a corrupt cache.
+func status(w http.ResponseWriter, r *http.Request) {
+	serverStatus := "ok"
+	movies := make(map[string]interface{})
+	for _, id := range library.Ids() {
+		entry, _ := library.Get(id)
+		renditions := make(map[string]interface{})
+		for key, rendition := range entry.Renditions() {
+			data := frameCountData(entry, rendition)
+			if err := rendition.Err(); err != nil {
+				data["Err"] = err.Error()
+			}
+			if data["Degraded"] == true {
+				serverStatus = "degraded"
+			}
+			renditions[key.String()] = data
+		}
+		movies[id] = renditions
 	}
-	if err = os.Rename(cacheFileTmp, cacheFilePath); err != nil {
-		fatal(err)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"Status": serverStatus, "Movies": movies}); err != nil {
+		http.Error(w, err.Error(), 500)
 	}
 }
 
-func warmUp() {
-	log.Println("warming up server...")
-	moviePath := filepath.Join(config.ResourcesPath, "demo.m4v")
-	cachePath := moviePath + ".cache"
+// A request may carry an id chosen by the client, which is copied to every
+// response to it.
+type WSRequest struct {
+	Type      string
+	Args      map[string]interface{}
+	RequestId interface{}
+}
 
-	if ok, err := LockFile(cachePath); !ok {
-		fatal(err)
+type WSResponse struct {
+	ErrorCode int
+	Type      string
+	Data      map[string]interface{}
+	RequestId interface{} `json:",omitempty"`
+}
+
+// formats are negotiated per connection, htmlclass is what the web player uses
+const defaultFormat = CACA_EXPORT_FMT_HTMLCLASS
+
+type PlayerSession struct {
+	conn    *websocket.Conn
+	format  CacaExportFormat
+	cols    int
+	mode    FrameMode
+	profile string      // empty to use each movie's configured profile
+	codecs  []string    // codecs the client decodes, nil to use each movie's codec
+	deltas  bool        // whether the client applies delta frames
+	live    *LiveStream // started by the first PLAY
+	playing string      // id of the movie last played live
+
+	transfer      *dataTransfer // the GETDATA request being served
+	audioTransfer *dataTransfer // the GETAUDIO request being served
+}
+
+func NewPlayerSession(conn *websocket.Conn) (*PlayerSession, error) {
+	session := &PlayerSession{conn: conn, format: defaultFormat, cols: config.DefaultColumns}
+	query := conn.Request().URL.Query()
+	if name := query.Get("format"); name != "" {
+		format, err := ParseCacaExportFormat(name)
+		if err != nil {
+			return nil, err
+		}
+		session.format = format
 	}
-	defer func() {
-		if ok, err := UnlockFile(cachePath); !ok {
-			fatal(err)
+	if name := query.Get("mode"); name != "" {
+		mode, err := ParseFrameMode(name)
+		if err != nil {
+			return nil, err
 		}
-	}()
-
-	if ok, err := checkFileExists(cachePath); ok {
-		readFromCache(cachePath)
-	} else if err == nil {
-		movie, err := loadMovie(moviePath)
+		session.mode = mode
+	}
+	if value := query.Get("cols"); value != "" {
+		cols, err := strconv.Atoi(value)
 		if err != nil {
-			fatal(err)
+			return nil, errors.New("Invalid columns: " + value)
 		}
-		converter, err := NewAsciiConverter(movie, 120)
+		session.cols = chooseColumns(cols)
+	}
+	if name := query.Get("profile"); name != "" {
+		if _, err := getRenderProfile(name); err != nil {
+			return nil, err
+		}
+		session.profile = name
+	}
+	if list := query.Get("codecs"); list != "" {
+		codecs, err := parseCodecList(list)
 		if err != nil {
-			fatal(err)
+			return nil, err
 		}
-		defer converter.Free()
-
-		data = new(CachingData)
-		data.VideoBuffer = make([]string, movie.FrameCount)
-		data.FrameCount = 0
-		for image := range movie.ImageStream {
-			htmlDiv, err := converter.ConvertToHtml(image)
-			if err != nil {
-				fatal(err)
-			}
-
-			var b bytes.Buffer
-			w := gzip.NewWriter(&b)
-			if _, err := w.Write([]byte(htmlDiv)); err != nil {
-				fatal(err)
-			}
-			w.Close()
-
-			data.VideoBuffer[data.FrameCount] = b.String()
-			// data.VideoBuffer[data.FrameCount] = htmlDiv
-
-			if data.FrameCount%100 == 0 {
-				log.Println("Loading frame:", data.FrameCount)
-			}
-			data.FrameCount++
+		session.codecs = codecs
+	}
+	if value := query.Get("deltas"); value != "" {
+		deltas, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.New("Invalid deltas: " + value)
 		}
-		writeToCache(cachePath)
-	} else {
-		fatal(err)
+		session.deltas = deltas
 	}
-	log.Println("warming up done")
+	return session, nil
 }
 
-func root(w http.ResponseWriter, r *http.Request) {
-	var model = struct{ Host string }{config.WebsocketHost}
-	err := indexTmpl.Execute(w, model)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
+func (this *PlayerSession) renditionKey(entry *MovieEntry) RenditionKey {
+	profile := this.profile
+	if profile == "" {
+		profile = movieProfileName(entry.Id)
 	}
+	return RenditionKey{this.format, this.cols, profile, this.codec(entry)}
 }
 
-type WSRequest struct {
-	Type string
-	Args map[string]interface{}
+// codec picks the movie's codec if the client can decode it, so the cache
+// built at warm up is shared, or else the codec the client prefers.
+func (this *PlayerSession) codec(entry *MovieEntry) string {
+	codec := movieCodecName(entry.Id)
+	if this.codecs == nil {
+		return codec
+	}
+	for _, accepted := range this.codecs {
+		if accepted == codec {
+			return codec
+		}
+	}
+	return this.codecs[0]
 }
 
-type WSResponse struct {
-	ErrorCode int
-	Type      string
-	Data      map[string]interface{}
+// chooseColumns clamps a requested width to the configured limits and maps
+// it onto the nearest width the server renders.
+func chooseColumns(cols int) int {
+	if cols < config.MinColumns {
+		cols = config.MinColumns
+	} else if cols > config.MaxColumns {
+		cols = config.MaxColumns
+	}
+	return nearestColumnWidth(cols)
 }
 
 type SendDataArgs struct {
+	MovieId   string
 	FromFrame int
 	ToFrame   int
+	Wait      bool
 }
 
 func (this *SendDataArgs) Load(cmd *WSRequest) (err error) {
@@ -148,42 +214,390 @@ func (this *SendDataArgs) Load(cmd *WSRequest) (err error) {
 			err = r.(error)
 		}
 	}()
+	this.MovieId = movieIdArg(cmd)
 	this.FromFrame = int(cmd.Args["from"].(float64))
 	this.ToFrame = int(cmd.Args["to"].(float64))
+	this.Wait = true
+	if wait, ok := cmd.Args["wait"]; ok {
+		this.Wait = wait.(bool)
+	}
 	return nil
 }
 
-func sendData(conn *websocket.Conn, args *SendDataArgs) {
-	log.Println("Start streaming, from:", args.FromFrame, "to:", args.ToFrame)
+// playableMovie looks up a movie that has not failed to decode.
+func playableMovie(id string) (*MovieEntry, error) {
+	entry, err := library.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := entry.Err(); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// movieIdArg returns the optional "id" argument, or "" for the default movie.
+func movieIdArg(cmd *WSRequest) string {
+	if id, ok := cmd.Args["id"].(string); ok {
+		return id
+	}
+	return ""
+}
+
+// dataTransfer is a GETDATA or GETAUDIO request being served in the
+// background. Only one of each runs per session, a newer request preempts it.
+type dataTransfer struct {
+	cmdType   string
+	requestId interface{}
+	mode      FrameMode
+	deltas    bool
+	rendition *Rendition
+	cancel    chan struct{}
+	done      chan struct{}
+	reason    string // why it was cancelled, set before cancel is closed
+}
+
+// Cancel stops the transfer and waits until it has sent its last response.
+// It returns false if the transfer had already finished.
+func (this *dataTransfer) Cancel(reason string) bool {
+	select {
+	case <-this.done:
+		return false
+	default:
+	}
+	this.reason = reason
+	close(this.cancel)
+	this.rendition.Interrupt()
+	<-this.done
+	return true
+}
+
+func (this *dataTransfer) cancelled() bool {
+	select {
+	case <-this.cancel:
+		return true
+	default:
+		return false
+	}
+}
 
-	if args.FromFrame < 0 || args.FromFrame >= args.ToFrame || args.ToFrame > data.FrameCount {
+// startData preempts the transfer of the same type in flight and starts
+// serving args. GETAUDIO serves chunks of the audio track instead of frames.
+func startData(session *PlayerSession, cmdType string, args *SendDataArgs, requestId interface{}) {
+	if err := checkRequestId(session.mode, requestId); err != nil {
+		sendError(session.conn, cmdType, requestId, err)
+		return
+	}
+	slot := &session.transfer
+	if cmdType == "GETAUDIO" {
+		slot = &session.audioTransfer
+	}
+	if *slot != nil {
+		(*slot).Cancel("preempted")
+	}
+	entry, err := playableMovie(args.MovieId)
+	if err != nil {
+		sendError(session.conn, cmdType, requestId, err)
+		return
+	}
+	key := session.renditionKey(entry)
+	var rendition *Rendition
+	if cmdType == "GETAUDIO" {
+		rendition = entry.Audio(key.Codec)
+	} else {
+		rendition = entry.Rendition(key)
+	}
+
+	total, _, done := rendition.Counts()
+	// an audio track may turn out longer than estimated from the video
+	bounded := done || (total > 0 && cmdType != "GETAUDIO")
+	if args.FromFrame < 0 || args.FromFrame >= args.ToFrame || (bounded && args.ToFrame > total) {
 		log.Println("Illegal frame numbers")
-		sendError(conn, "GETDATA", errors.New("Invalid range"))
+		sendError(session.conn, cmdType, requestId, errors.New("Invalid range"))
 		return
 	}
 
-	for _, frame := range data.VideoBuffer[args.FromFrame:args.ToFrame] {
-		str := base64.StdEncoding.EncodeToString([]byte(frame))
-		websocket.JSON.Send(conn, WSResponse{200, "GETDATA", map[string]interface{}{"Frame": str}})
-		// websocket.JSON.Send(conn, WSResponse{200, "GETDATA", map[string]interface{}{"Frame": frame}})
+	*slot = &dataTransfer{
+		cmdType:   cmdType,
+		requestId: requestId,
+		mode:      session.mode,
+		deltas:    session.deltas,
+		rendition: rendition,
+		cancel:    make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go sendData(session.conn, entry, key, args, *slot)
+}
+
+// sendData streams frames as soon as they are converted. Frames beyond the
+// conversion watermark are waited for, unless the client asked not to wait,
+// in which case a 202 response tells it how far conversion has got. A
+// cancelled transfer ends with a CANCELLED response naming the first frame
+// that was not sent. The first frame sent is always a keyframe.
+func sendData(conn *websocket.Conn, entry *MovieEntry, key RenditionKey, args *SendDataArgs, transfer *dataTransfer) {
+	defer close(transfer.done)
+	log.Println("Start streaming, movie:", entry.Id, "rendition:", key, "from:", args.FromFrame, "to:", args.ToFrame)
+	rendition := transfer.rendition
+	assembler := newFrameAssembler(rendition, key.Format)
+
+	for i := args.FromFrame; i < args.ToFrame; i++ {
+		var frame StoredFrame
+		var generation int
+		var err error
+		if transfer.cancelled() {
+			err = ErrCancelled
+		} else {
+			frame, generation, err = rendition.ReadFrame(i, args.Wait, transfer.cancel)
+		}
+
+		if err == ErrCancelled {
+			log.Println("Streaming", transfer.reason, "movie:", entry.Id, "at:", i)
+			websocket.JSON.Send(conn, WSResponse{200, "CANCELLED", map[string]interface{}{"Id": entry.Id, "Index": i, "Reason": transfer.reason}, transfer.requestId})
+			return
+		} else if err == ErrFrameNotReady {
+			_, converted, _ := rendition.Counts()
+			websocket.JSON.Send(conn, WSResponse{202, transfer.cmdType, map[string]interface{}{"Id": entry.Id, "Index": i, "ConvertedFrames": converted}, transfer.requestId})
+			return
+		} else if err == nil {
+			frame, err = assembler.Next(i, generation, frame, transfer.deltas)
+		}
+		if err != nil {
+			sendError(conn, transfer.cmdType, transfer.requestId, err)
+			return
+		}
+		sendFrame(conn, transfer.mode, transfer.cmdType, transfer.requestId, entry, key, i, frame)
 	}
 
-	log.Println("Finished streaming, from:", args.FromFrame, "to:", args.ToFrame)
+	log.Println("Finished streaming, movie:", entry.Id, "from:", args.FromFrame, "to:", args.ToFrame)
+}
+
+// cancelData aborts the transfer with the id given in the "request"
+// argument, or every transfer in flight if there is none.
+func cancelData(session *PlayerSession, cmd *WSRequest) {
+	cancelled := false
+	for _, transfer := range []*dataTransfer{session.transfer, session.audioTransfer} {
+		if transfer == nil {
+			continue
+		}
+		if id, ok := cmd.Args["request"]; !ok || reflect.DeepEqual(id, transfer.requestId) {
+			cancelled = transfer.Cancel("cancelled") || cancelled
+		}
+	}
+	websocket.JSON.Send(session.conn, WSResponse{200, "CANCEL", map[string]interface{}{"Cancelled": cancelled}, cmd.RequestId})
 }
 
-func sendFrameCount(conn *websocket.Conn) {
-	log.Println("Send frame count:", data.FrameCount)
-	websocket.JSON.Send(conn, WSResponse{200, "GETFRAMECOUNT", map[string]interface{}{"FrameCount": data.FrameCount}})
+func chunkData(entry *MovieEntry, index int, frame StoredFrame) map[string]interface{} {
+	codec := "unknown"
+	if frameCodec, err := GetFrameCodecById(frame.Codec); err == nil {
+		codec = frameCodec.Name()
+	}
+	return map[string]interface{}{
+		"Id":        entry.Id,
+		"Codec":     codec,
+		"Index":     index,
+		"Timestamp": int64(frame.Timestamp / time.Millisecond),
+		"Keyframe":  frame.Keyframe,
+		"Frame":     base64.StdEncoding.EncodeToString(frame.Payload),
+	}
+}
+
+func frameData(entry *MovieEntry, key RenditionKey, index int, frame StoredFrame) map[string]interface{} {
+	data := chunkData(entry, index, frame)
+	data["Format"] = key.Format.String()
+	data["Columns"] = key.Cols
+	data["Profile"] = key.Profile
+	return data
+}
+
+// sendAudioInfo describes the audio track of a movie. The sample format is
+// 0 until extraction has started.
+func sendAudioInfo(session *PlayerSession, cmd *WSRequest) {
+	entry, err := playableMovie(movieIdArg(cmd))
+	if err != nil {
+		sendError(session.conn, cmd.Type, cmd.RequestId, err)
+		return
+	}
+	audio := entry.Audio(session.codec(entry))
+	total, converted, done := audio.Counts()
+	data := map[string]interface{}{
+		"Id":              entry.Id,
+		"HasAudio":        audio.Err() != ErrNoAudio,
+		"ChunkCount":      total,
+		"ConvertedChunks": converted,
+		"Done":            done,
+		"SampleRate":      0,
+		"Channels":        0,
+	}
+	if header, ok := audio.Header(); ok {
+		data["SampleRate"] = header.SampleRate
+		data["Channels"] = header.Channels
+	}
+	websocket.JSON.Send(session.conn, WSResponse{200, cmd.Type, data, cmd.RequestId})
+}
+
+func frameCountData(entry *MovieEntry, rendition *Rendition) map[string]interface{} {
+	total, converted, done, degraded := entry.FrameCount, 0, false, false
+	frameRate := entry.FrameRate
+	if rendition != nil {
+		total, converted, done = rendition.Counts()
+		degraded = rendition.Degraded()
+		frameRate = rendition.FrameRate()
+	}
+	data := map[string]interface{}{"Id": entry.Id, "FrameCount": total, "FrameRate": frameRate, "ConvertedFrames": converted, "Done": done, "Degraded": degraded}
+	if err := entry.Err(); err != nil {
+		data["Failed"] = err.Error()
+	}
+	return data
+}
+
+func sendFrameCount(session *PlayerSession, cmd *WSRequest) {
+	entry, err := playableMovie(movieIdArg(cmd))
+	if err != nil {
+		sendError(session.conn, "GETFRAMECOUNT", cmd.RequestId, err)
+		return
+	}
+	data := frameCountData(entry, entry.Rendition(session.renditionKey(entry)))
+	log.Println("Send frame count:", data)
+	websocket.JSON.Send(session.conn, WSResponse{200, "GETFRAMECOUNT", data, cmd.RequestId})
 	log.Println("Finish send frame count")
 }
 
-func sendError(conn *websocket.Conn, cmdType string, err error) {
+// sendMovieList reports progress of the session's rendition without starting
+// conversion of movies the client has not asked for.
+func sendMovieList(session *PlayerSession, cmd *WSRequest) {
+	movies := make([]map[string]interface{}, 0, len(library.Ids()))
+	for _, id := range library.Ids() {
+		entry, _ := library.Get(id)
+		movies = append(movies, frameCountData(entry, entry.PeekRendition(session.renditionKey(entry))))
+	}
+	log.Println("Send movie list:", library.Ids())
+	websocket.JSON.Send(session.conn, WSResponse{200, "LISTMOVIES", map[string]interface{}{"Movies": movies}, cmd.RequestId})
+	log.Println("Finish send movie list")
+}
+
+func setFormat(session *PlayerSession, cmd *WSRequest) {
+	name, _ := cmd.Args["format"].(string)
+	format, err := ParseCacaExportFormat(name)
+	if err != nil {
+		sendError(session.conn, cmd.Type, cmd.RequestId, err)
+		return
+	}
+	session.format = format
+	log.Println("Set format:", format)
+	websocket.JSON.Send(session.conn, WSResponse{200, "SETFORMAT", map[string]interface{}{"Format": format.String()}, cmd.RequestId})
+}
+
+func sendFormatList(session *PlayerSession, cmd *WSRequest) {
+	websocket.JSON.Send(session.conn, WSResponse{200, "LISTFORMATS", map[string]interface{}{"Formats": CacaExportFormats(), "Format": session.format.String()}, cmd.RequestId})
+}
+
+func sendProfileList(session *PlayerSession, cmd *WSRequest) {
+	profiles := map[string]*RenderProfile{defaultProfileName: DefaultRenderProfile}
+	for name, profile := range config.Profiles {
+		profiles[name] = profile
+	}
+	websocket.JSON.Send(session.conn, WSResponse{200, "LISTPROFILES", map[string]interface{}{"Profiles": profiles, "Options": GetDitherCatalog(), "Scalers": ScaleFilterNames()}, cmd.RequestId})
+}
+
+// setMode switches between JSON and binary frames. Frames of requests
+// already being served keep their mode.
+func setMode(session *PlayerSession, cmd *WSRequest) {
+	name, _ := cmd.Args["mode"].(string)
+	mode, err := ParseFrameMode(name)
+	if err != nil {
+		sendError(session.conn, cmd.Type, cmd.RequestId, err)
+		return
+	}
+	if err := checkRequestId(mode, cmd.RequestId); err != nil {
+		sendError(session.conn, cmd.Type, cmd.RequestId, err)
+		return
+	}
+	session.mode = mode
+	log.Println("Set frame mode:", mode)
+	websocket.JSON.Send(session.conn, WSResponse{200, "SETMODE", map[string]interface{}{"Mode": mode.String()}, cmd.RequestId})
+}
+
+// setProfile selects a configured render profile, or the movie's own
+// profile when the name is empty.
+func setProfile(session *PlayerSession, cmd *WSRequest) {
+	name, _ := cmd.Args["profile"].(string)
+	if name != "" {
+		if _, err := getRenderProfile(name); err != nil {
+			sendError(session.conn, cmd.Type, cmd.RequestId, err)
+			return
+		}
+	}
+	session.profile = name
+	log.Println("Set profile:", name)
+	websocket.JSON.Send(session.conn, WSResponse{200, "SETPROFILE", map[string]interface{}{"Profile": name}, cmd.RequestId})
+}
+
+// setColumns replies with the width actually chosen for the session.
+func setColumns(session *PlayerSession, cmd *WSRequest) {
+	cols, ok := cmd.Args["cols"].(float64)
+	if !ok {
+		sendError(session.conn, cmd.Type, cmd.RequestId, errors.New("Missing columns"))
+		return
+	}
+	chosen := chooseColumns(int(cols))
+	session.cols = chosen
+	log.Println("Set columns:", chosen)
+	websocket.JSON.Send(session.conn, WSResponse{200, "SETCOLUMNS", map[string]interface{}{"Columns": chosen}, cmd.RequestId})
+}
+
+// liveControl forwards PLAY, PAUSE and SEEK to the session's live stream.
+// PLAY switches to the given movie, or resumes the current one, rendered
+// with the session's current settings. The position is moved to the "frame"
+// argument, or to the frame presented at "time" in milliseconds.
+func liveControl(session *PlayerSession, cmd *WSRequest) {
+	if cmd.Type == "PLAY" {
+		if err := checkRequestId(session.mode, cmd.RequestId); err != nil {
+			sendError(session.conn, cmd.Type, cmd.RequestId, err)
+			return
+		}
+	}
+	live := &liveCommand{Type: cmd.Type, RequestId: cmd.RequestId, Mode: session.mode, Deltas: session.deltas, Frame: -1, Time: -1}
+	if frame, ok := cmd.Args["frame"].(float64); ok {
+		if frame < 0 {
+			sendError(session.conn, cmd.Type, cmd.RequestId, errors.New("Invalid frame"))
+			return
+		}
+		live.Frame = int(frame)
+	} else if ms, ok := cmd.Args["time"].(float64); ok {
+		if ms < 0 {
+			sendError(session.conn, cmd.Type, cmd.RequestId, errors.New("Invalid time"))
+			return
+		}
+		live.Time = time.Duration(ms * float64(time.Millisecond))
+	}
+	if cmd.Type == "PLAY" {
+		id := movieIdArg(cmd)
+		if id == "" {
+			id = session.playing
+		}
+		entry, err := playableMovie(id)
+		if err != nil {
+			sendError(session.conn, cmd.Type, cmd.RequestId, err)
+			return
+		}
+		live.Entry, live.Key = entry, session.renditionKey(entry)
+		live.Rendition = entry.Rendition(live.Key)
+		session.playing = entry.Id
+	}
+	if session.live == nil {
+		session.live = NewLiveStream(session.conn)
+	}
+	session.live.Send(live)
+}
+
+func sendError(conn *websocket.Conn, cmdType string, requestId interface{}, err error) {
 	log.Println("Send error:", err)
-	websocket.JSON.Send(conn, WSResponse{500, cmdType, map[string]interface{}{"Err": err.Error()}})
+	websocket.JSON.Send(conn, WSResponse{500, cmdType, map[string]interface{}{"Err": err.Error()}, requestId})
 	log.Println("Finish send error")
 }
 
-func workingProc(conn *websocket.Conn, cmdQueue <-chan *WSRequest, wg *sync.WaitGroup) {
+func workingProc(session *PlayerSession, cmdQueue <-chan *WSRequest, wg *sync.WaitGroup) {
+	conn := session.conn
 	wg.Add(1)
 	defer wg.Done()
 
@@ -193,27 +607,61 @@ func workingProc(conn *websocket.Conn, cmdQueue <-chan *WSRequest, wg *sync.Wait
 		} else {
 			// process cmd
 			switch cmd.Type {
-			case "GETDATA":
+			case "GETDATA", "GETAUDIO":
 				args := new(SendDataArgs)
 				if err := args.Load(cmd); err != nil {
-					sendError(conn, cmd.Type, err)
+					sendError(conn, cmd.Type, cmd.RequestId, err)
 				} else {
-					sendData(conn, args)
+					startData(session, cmd.Type, args, cmd.RequestId)
 				}
+			case "CANCEL":
+				cancelData(session, cmd)
 			case "GETFRAMECOUNT":
-				sendFrameCount(conn)
+				sendFrameCount(session, cmd)
+			case "GETAUDIOINFO":
+				sendAudioInfo(session, cmd)
+			case "LISTMOVIES":
+				sendMovieList(session, cmd)
+			case "SETFORMAT":
+				setFormat(session, cmd)
+			case "LISTFORMATS":
+				sendFormatList(session, cmd)
+			case "SETMODE":
+				setMode(session, cmd)
+			case "SETCOLUMNS":
+				setColumns(session, cmd)
+			case "LISTPROFILES":
+				sendProfileList(session, cmd)
+			case "SETPROFILE":
+				setProfile(session, cmd)
+			case "PLAY", "PAUSE", "SEEK":
+				liveControl(session, cmd)
 			default:
-				sendError(conn, cmd.Type, errors.New(fmt.Sprintf("Unknown command: %#v", cmd)))
+				sendError(conn, cmd.Type, cmd.RequestId, errors.New(fmt.Sprintf("Unknown command: %#v", cmd)))
 			}
 		}
 	}
+	if session.transfer != nil {
+		session.transfer.Cancel("closed")
+	}
+	if session.audioTransfer != nil {
+		session.audioTransfer.Cancel("closed")
+	}
+	if session.live != nil {
+		session.live.Stop()
+	}
 }
 
 func websocketHandler(conn *websocket.Conn) {
 	log.Println("Begin serving connection:", conn)
+	session, err := NewPlayerSession(conn)
+	if err != nil {
+		sendError(conn, "CONNECT", nil, err)
+		return
+	}
 	var wg sync.WaitGroup
 	commandQueue := make(chan *WSRequest, 10)
-	go workingProc(conn, commandQueue, &wg)
+	go workingProc(session, commandQueue, &wg)
 	for {
 		// try read command from conn
 		var cmd WSRequest
@@ -257,6 +705,7 @@ func registerHandler() {
 	serveStatic("css")
 
 	http.HandleFunc("/", root)
+	http.HandleFunc("/status", status)
 	http.Handle("/play", NewPlayerServer())
 }
 
@@ -269,9 +718,11 @@ func serve() {
 }
 
 func startServer() {
-	loadConfig()
+	if err := loadConfig(os.Args[1:]); err != nil {
+		fatal(err)
+	}
 	bootstrap()
-	warmUp()
 	registerHandler()
+	warmUp()
 	serve()
 }